@@ -0,0 +1,291 @@
+package unipay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultMaxBodySize = 1 << 20
+
+// Binder 从http请求解析支付上下文
+// 支持application/json, application/x-www-form-urlencoded和multipart/form-data, 字段名与Request的json tag一致
+// 附件信息使用attach字段, json中可以是字符串或对象; Uid需要调用方根据登录态设置
+// Request.PayWay的编号由业务定义, 需要通过PayWays配置pay_way名称到编号的映射
+type Binder struct {
+	payWays     map[string]uint8
+	proxies     []*net.IPNet
+	maxBodySize int64
+	err         error
+}
+
+type BindOption func(*Binder)
+
+func NewBinder(opts ...BindOption) *Binder {
+	b := &Binder{
+		maxBodySize: defaultMaxBodySize,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// TrustedProxies 可信的反向代理, IP或CIDR
+// 只有直连地址是可信代理时才使用X-Forwarded-For/X-Real-IP, 默认不信任任何代理, ClientIP为直连地址
+func TrustedProxies(proxies ...string) BindOption {
+	return func(b *Binder) {
+		for _, p := range proxies {
+			cidr := p
+			if !strings.Contains(p, "/") {
+				if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				b.err = fmt.Errorf("unipay: invalid trusted proxy %s", p)
+				return
+			}
+			b.proxies = append(b.proxies, ipnet)
+		}
+	}
+}
+
+// PayWays pay_way名称到编号的映射, 必须配置
+// pay_way只接受映射中的名称或编号; 必填字段按名称校验, 例如映射到PayWay_AppStore的编号需要receipt-data
+func PayWays(payWays map[string]uint8) BindOption {
+	return func(b *Binder) {
+		b.payWays = payWays
+	}
+}
+
+// MaxBodySize 请求体的最大字节数, 默认1MB
+func MaxBodySize(n int64) BindOption {
+	return func(b *Binder) {
+		b.maxBodySize = n
+	}
+}
+
+// BindContext 使用默认配置和opts解析支付上下文
+func BindContext(r *http.Request, opts ...BindOption) (*Context, error) {
+	return NewBinder(opts...).Bind(r)
+}
+
+// bindRequest pay_way可以是名称或编号, 字符串或数字; attach不在Request的json中
+type bindRequest struct {
+	Request
+
+	PayWay json.RawMessage `json:"pay_way"`
+	Attach json.RawMessage `json:"attach"`
+}
+
+// Bind 解析请求参数, 客户端IP, 并校验pay_way对应的必填字段
+// 参数错误时返回ErrInvalidRequest
+func (b *Binder) Bind(r *http.Request) (*Context, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.payWays) == 0 {
+		return nil, errors.New("unipay: pay_way mapping not configured")
+	}
+
+	// ParseMultipartForm的参数只限制内存, 请求体大小需要在读取前限制
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(nil, r.Body, b.maxBodySize)
+	}
+
+	ctx := &Context{}
+
+	var (
+		payWay string
+		err    error
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		payWay, err = b.bindJSON(r, ctx)
+	case "multipart/form-data":
+		if err = r.ParseMultipartForm(b.maxBodySize); err == nil {
+			payWay = bindForm(r.Form, ctx)
+		}
+	default:
+		if err = r.ParseForm(); err == nil {
+			payWay = bindForm(r.Form, ctx)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidRequest) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+	}
+
+	if err = b.bindPayWay(payWay, ctx); err != nil {
+		return nil, err
+	}
+
+	ctx.Currency = ctx.Request.Currency
+	ctx.ClientIP = b.clientIP(r)
+	return ctx, nil
+}
+
+func (b *Binder) bindJSON(r *http.Request, ctx *Context) (string, error) {
+	if r.Body == nil {
+		return "", fmt.Errorf("%w: body required", ErrInvalidRequest)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var req bindRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+	}
+	ctx.Request = req.Request
+	ctx.Attach = rawString(req.Attach)
+
+	// 其他字段放入Params, 非字符串的值保留json原文
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+	}
+	ctx.Params = url.Values{}
+	for k, v := range r.URL.Query() {
+		ctx.Params[k] = v
+	}
+	for k, v := range fields {
+		ctx.Params.Set(k, rawString(v))
+	}
+
+	return rawString(req.PayWay), nil
+}
+
+// rawString json字符串返回字符串值, 其他类型返回原文, null返回空
+func rawString(raw json.RawMessage) string {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// bindForm 返回pay_way参数
+func bindForm(form url.Values, ctx *Context) string {
+	req := &ctx.Request
+	req.ReceiptData = form.Get("receipt-data")
+	req.PurchaseData = form.Get("purchase_data")
+	req.PurchaseDataSign = form.Get("purchase_data_sign")
+	req.TransactionId = form.Get("transaction_id")
+	req.OriginalTransactionID = form.Get("original_transaction_id")
+	req.ProductID = form.Get("goods_sn")
+	req.Timestamp = form.Get("timestamp")
+	req.Currency = form.Get("currency")
+	req.Nonce = form.Get("nonce")
+	req.Sign = form.Get("sign")
+	req.Attach = form.Get("attach")
+
+	ctx.Params = form
+	return form.Get("pay_way")
+}
+
+func (b *Binder) bindPayWay(payWay string, ctx *Context) error {
+	payWay = strings.TrimSpace(payWay)
+	if payWay == "" {
+		return fmt.Errorf("%w: pay_way required", ErrInvalidRequest)
+	}
+
+	var name string
+	if n, err := strconv.ParseUint(payWay, 10, 8); err == nil {
+		ctx.PayWay = uint8(n)
+		for k, v := range b.payWays {
+			if v == ctx.PayWay {
+				name = k
+				break
+			}
+		}
+		if name == "" {
+			return fmt.Errorf("%w: unknown pay_way %s", ErrInvalidRequest, payWay)
+		}
+	} else {
+		name = strings.ToLower(payWay)
+		v, ok := b.payWays[name]
+		if !ok {
+			return fmt.Errorf("%w: unknown pay_way %s", ErrInvalidRequest, payWay)
+		}
+		ctx.PayWay = v
+	}
+
+	switch name {
+	case PayWay_AppStore:
+		if ctx.ReceiptData == "" {
+			return fmt.Errorf("%w: receipt-data required", ErrInvalidRequest)
+		}
+	case PayWay_PlayStore:
+		if ctx.PurchaseData == "" || ctx.PurchaseDataSign == "" {
+			return fmt.Errorf("%w: purchase_data and purchase_data_sign required", ErrInvalidRequest)
+		}
+	}
+	return nil
+}
+
+// clientIP 直连地址是可信代理时, 从右向左取X-Forwarded-For中第一个不可信的地址, 其次是X-Real-IP
+func (b *Binder) clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		remote = strings.TrimSpace(r.RemoteAddr)
+	}
+	if !b.trusted(remote) {
+		return remote
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		ips := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if net.ParseIP(ip) == nil {
+				break
+			}
+			if i == 0 || !b.trusted(ip) {
+				return ip
+			}
+		}
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return remote
+}
+
+func (b *Binder) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range b.proxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
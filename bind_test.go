@@ -0,0 +1,147 @@
+package unipay
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testPayWays = PayWays(map[string]uint8{
+	PayWay_AppStore:  1,
+	PayWay_PlayStore: 2,
+	PayWay_WxPay:     5,
+})
+
+func newBindRequest(contentType, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/pay", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+func TestBind(t *testing.T) {
+	const (
+		jsonType = "application/json"
+		formType = "application/x-www-form-urlencoded"
+	)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		payWay      uint8
+		err         bool
+	}{
+		{"json name", jsonType, `{"pay_way":"wxpay","goods_sn":"g1"}`, 5, false},
+		{"json number", jsonType, `{"pay_way":5,"goods_sn":"g1"}`, 5, false},
+		{"json numeric string", jsonType, `{"pay_way":"5"}`, 5, false},
+		{"form name", formType, `pay_way=WxPay&goods_sn=g1`, 5, false},
+		{"form number", formType, `pay_way=5`, 5, false},
+		{"appstore", jsonType, `{"pay_way":"appstore","receipt-data":"r"}`, 1, false},
+		{"missing pay_way", jsonType, `{"goods_sn":"g1"}`, 0, true},
+		{"unknown name", jsonType, `{"pay_way":"bitcoin"}`, 0, true},
+		{"unknown number", jsonType, `{"pay_way":3}`, 0, true},
+		{"unknown number form", formType, `pay_way=9`, 0, true},
+		{"appstore without receipt", jsonType, `{"pay_way":1}`, 0, true},
+		{"playstore without sign", formType, `pay_way=playstore&purchase_data=d`, 0, true},
+		{"invalid json", jsonType, `{"pay_way":`, 0, true},
+		{"oversize json", jsonType, `{"pay_way":5,"goods_sn":"` + strings.Repeat("a", 64) + `"}`, 0, true},
+		{"oversize form", formType, `pay_way=5&goods_sn=` + strings.Repeat("a", 64), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := BindContext(newBindRequest(tt.contentType, tt.body), testPayWays, MaxBodySize(64))
+			if tt.err {
+				if !errors.Is(err, ErrInvalidRequest) {
+					t.Fatalf("got %v, want ErrInvalidRequest", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ctx.PayWay != tt.payWay {
+				t.Fatalf("pay way %d, want %d", ctx.PayWay, tt.payWay)
+			}
+		})
+	}
+}
+
+func TestBindAttach(t *testing.T) {
+	ctx, err := BindContext(newBindRequest("application/json",
+		`{"pay_way":"wxpay","attach":{"channel":"test"},"extra":1}`), testPayWays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Attach != `{"channel":"test"}` || ctx.Params.Get("extra") != "1" {
+		t.Fatalf("attach %s, params %v", ctx.Attach, ctx.Params)
+	}
+}
+
+func TestBindMultipartOversize(t *testing.T) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("pay_way", "wxpay")
+	w.WriteField("goods_sn", strings.Repeat("a", 1024))
+	w.Close()
+
+	r := newBindRequest(w.FormDataContentType(), body.String())
+	if _, err := BindContext(r, testPayWays, MaxBodySize(512)); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestBindConfig(t *testing.T) {
+	if _, err := BindContext(newBindRequest("application/json", `{"pay_way":5}`)); err == nil {
+		t.Fatal("bind without pay_way mapping")
+	}
+	if _, err := BindContext(newBindRequest("application/json", `{"pay_way":5}`), testPayWays, TrustedProxies("10.0.0.0/33")); err == nil {
+		t.Fatal("invalid trusted proxy")
+	}
+}
+
+func TestBindClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		remote  string
+		xff     string
+		realIP  string
+		want    string
+	}{
+		{"no proxy", nil, "1.1.1.1:1234", "2.2.2.2", "3.3.3.3", "1.1.1.1"},
+		{"untrusted remote", []string{"10.0.0.0/8"}, "1.1.1.1:1234", "2.2.2.2", "", "1.1.1.1"},
+		{"trusted remote", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "2.2.2.2", "", "2.2.2.2"},
+		{"spoofed xff", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "9.9.9.9, 2.2.2.2", "", "2.2.2.2"},
+		{"proxy chain", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "2.2.2.2, 10.0.0.2", "", "2.2.2.2"},
+		{"all trusted", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"invalid xff", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "unknown", "", "10.0.0.1"},
+		{"real ip", []string{"10.0.0.1"}, "10.0.0.1:1234", "", "2.2.2.2", "2.2.2.2"},
+		{"ipv6", []string{"::1"}, "[::1]:1234", "2001:db8::1", "", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newBindRequest("application/json", `{"pay_way":"wxpay"}`)
+			r.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			ctx, err := BindContext(r, testPayWays, TrustedProxies(tt.proxies...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ctx.ClientIP != tt.want {
+				t.Fatalf("client ip %s, want %s", ctx.ClientIP, tt.want)
+			}
+		})
+	}
+}
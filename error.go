@@ -1,13 +1,49 @@
 package unipay
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// 苹果/google订单不存在
 	OrderNotFoundError = errors.New("transaction not found")
 )
 
-func IsOrderNotFondError(err error) bool {
-	// return err == OrderNotFoundError
+// 各支付客户端返回的错误, 可通过errors.Is判断, 错误信息中附带订单号等上下文
+var (
+	ErrConcurrentProcessing = errors.New("concurrency deal")     // 并发处理同一笔订单, 未获得锁
+	ErrBundleMismatch       = errors.New("bundle mismatch")      // bundle id/package name/app id/商户号与配置不一致
+	ErrSignatureInvalid     = errors.New("invalid signature")    // 通知或回调的签名校验失败
+	ErrAmountMismatch       = errors.New("amount mismatch")      // 支付金额或币种与订单不一致
+	ErrProviderUnavailable  = errors.New("provider unavailable") // 第三方支付暂时不可用, 可稍后重试
+	ErrRequestReplayed      = errors.New("request replayed")     // 客户端请求的nonce已被使用
+	ErrInvalidRequest       = errors.New("invalid request")      // 客户端请求参数缺失或格式错误
+)
+
+// ProviderError 第三方支付返回的错误, 可通过errors.As获取
+// Retryable为true时errors.Is(err, ErrProviderUnavailable)成立
+type ProviderError struct {
+	PayWay    string // 支付方式, 如PayWay_WxPay
+	Code      string // 第三方支付的错误码
+	Message   string // 第三方支付的错误描述
+	Retryable bool   // 系统繁忙/网关错误等临时错误, 可使用相同参数重试
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s: %s %s", e.PayWay, e.Code, e.Message)
+}
+
+func (e *ProviderError) Is(target error) bool {
+	return e.Retryable && target == ErrProviderUnavailable
+}
+
+// IsOrderNotFoundError 订单不存在
+func IsOrderNotFoundError(err error) bool {
 	return errors.Is(err, OrderNotFoundError)
 }
+
+// Deprecated: 使用IsOrderNotFoundError
+func IsOrderNotFondError(err error) bool {
+	return IsOrderNotFoundError(err)
+}
@@ -0,0 +1,328 @@
+package unipay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLockTTL LockerV2的默认过期时间
+	DefaultLockTTL = 30 * time.Second
+
+	// defaultLockRetryInterval 等待锁时的重试间隔
+	defaultLockRetryInterval = 50 * time.Millisecond
+
+	// minLockTTL LockerV2的最小过期时间, 持有期间每TTL/3续期, 过小的TTL无法及时续期
+	minLockTTL = time.Second
+)
+
+// LockerV2 带过期时间的订单锁, Locker可选实现
+// 持有锁的进程崩溃后锁在ttl后自动过期; 解锁和续期需要TryLock返回的token, 防止释放其他持有者的锁
+type LockerV2 interface {
+	Locker
+
+	// TryLock 获取锁, 获得锁时返回持有者token, 锁被其他持有者占用时返回ok为false
+	TryLock(orderId string, ttl time.Duration) (token string, ok bool, err error)
+
+	// Renew 续期, token不匹配或锁已过期时返回false
+	Renew(orderId, token string, ttl time.Duration) (bool, error)
+
+	// Release 释放锁, token不匹配时不做处理
+	Release(orderId, token string) error
+}
+
+// LockOptions 各支付客户端获取订单锁的配置
+type LockOptions struct {
+	TTL           time.Duration // 锁的过期时间, 仅LockerV2使用, 0表示DefaultLockTTL, 小于1秒时使用1秒; 持有期间每TTL/3自动续期
+	Wait          time.Duration // 未获得锁时等待的最长时间, 0表示立即返回ErrConcurrentProcessing
+	RetryInterval time.Duration // 等待锁时的重试间隔, 0表示50ms; MemoryLocker在锁释放时直接唤醒, 不使用该值
+}
+
+// AcquireLock 获取订单锁, 成功时返回释放锁的函数
+// locker实现了LockerV2时使用带过期时间和token的锁, 否则使用Locker.Lock
+// 超过Wait仍未获得锁时返回ErrConcurrentProcessing; Lock返回的错误直接返回, 不视为获得锁
+func AcquireLock(locker Locker, orderId string, opts LockOptions) (release func(), err error) {
+	if locker == nil {
+		return func() {}, nil
+	}
+
+	ttl := opts.TTL
+	switch {
+	case ttl <= 0:
+		ttl = DefaultLockTTL
+	case ttl < minLockTTL:
+		ttl = minLockTTL
+	}
+	interval := opts.RetryInterval
+	if interval <= 0 {
+		interval = defaultLockRetryInterval
+	}
+
+	v2, _ := locker.(LockerV2)
+	deadline := time.Now().Add(opts.Wait)
+	for {
+		var token string
+		var ok bool
+		if v2 != nil {
+			token, ok, err = v2.TryLock(orderId, ttl)
+		} else {
+			ok, err = locker.Lock(orderId)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			if v2 != nil {
+				return keepLock(v2, orderId, token, ttl), nil
+			}
+			return func() { locker.UnLock(orderId) }, nil
+		}
+
+		if waiter, ok := locker.(lockWaiter); ok {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, fmt.Errorf("%w: %s", ErrConcurrentProcessing, orderId)
+			}
+			waiter.waitUnlock(orderId, remaining)
+			continue
+		}
+
+		if !time.Now().Add(interval).Before(deadline) {
+			// 并发处理同一笔订单, 未获得锁
+			return nil, fmt.Errorf("%w: %s", ErrConcurrentProcessing, orderId)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// keepLock 持有锁期间定时续期, 返回释放锁的函数
+func keepLock(locker LockerV2, orderId, token string, ttl time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// 锁已过期或被抢占时停止续期
+				if ok, err := locker.Renew(orderId, token, ttl); err == nil && !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			locker.Release(orderId, token)
+		})
+	}
+}
+
+// newLockToken 随机生成锁的持有者token
+func newLockToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// lockWaiter 可以等待锁被释放的Locker, AcquireLock等待锁时不再按RetryInterval轮询
+type lockWaiter interface {
+	// waitUnlock 等待orderId的锁被释放或过期, 最多等待d
+	waitUnlock(orderId string, d time.Duration)
+}
+
+// memoryLockSweepInterval MemoryLocker清理过期锁的间隔
+const memoryLockSweepInterval = time.Minute
+
+// MemoryLocker 进程内的LockerV2, 每个订单号一把锁, 适用于单实例部署
+// 不同订单号的加锁互不阻塞; 等待锁时在该订单号的锁释放或过期后立即重试, 过期的锁定期清理
+type MemoryLocker struct {
+	locks sync.Map // orderId -> *memoryLock
+
+	sweepMu   sync.Mutex
+	sweepedAt time.Time
+}
+
+type memoryLock struct {
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+	released  chan struct{} // 持有者释放锁时关闭
+	removed   bool          // 已从locks中删除, 需要重新获取
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{sweepedAt: time.Now()}
+}
+
+func (lock *memoryLock) held(now time.Time) bool {
+	return lock.token != "" && now.Before(lock.expiresAt)
+}
+
+// entry 返回orderId的锁并加锁, 不存在时创建
+func (l *MemoryLocker) entry(orderId string) *memoryLock {
+	for {
+		v, _ := l.locks.LoadOrStore(orderId, &memoryLock{})
+		lock := v.(*memoryLock)
+		lock.mu.Lock()
+		if !lock.removed {
+			return lock
+		}
+		lock.mu.Unlock()
+	}
+}
+
+// load 返回orderId已存在的锁并加锁, 不存在时返回nil
+func (l *MemoryLocker) load(orderId string) *memoryLock {
+	v, ok := l.locks.Load(orderId)
+	if !ok {
+		return nil
+	}
+
+	lock := v.(*memoryLock)
+	lock.mu.Lock()
+	if lock.removed {
+		lock.mu.Unlock()
+		return nil
+	}
+	return lock
+}
+
+// remove 删除锁并唤醒等待者, 调用方需持有lock.mu
+func (l *MemoryLocker) remove(orderId string, lock *memoryLock) {
+	lock.removed = true
+	l.locks.Delete(orderId)
+	if lock.released != nil {
+		close(lock.released)
+		lock.released = nil
+	}
+}
+
+// sweep 每memoryLockSweepInterval清理一次过期的锁
+func (l *MemoryLocker) sweep(now time.Time) {
+	l.sweepMu.Lock()
+	if now.Sub(l.sweepedAt) < memoryLockSweepInterval {
+		l.sweepMu.Unlock()
+		return
+	}
+	l.sweepedAt = now
+	l.sweepMu.Unlock()
+
+	l.locks.Range(func(key, value interface{}) bool {
+		lock := value.(*memoryLock)
+		lock.mu.Lock()
+		if !lock.removed && !lock.held(now) {
+			l.remove(key.(string), lock)
+		}
+		lock.mu.Unlock()
+		return true
+	})
+}
+
+func (l *MemoryLocker) TryLock(orderId string, ttl time.Duration) (string, bool, error) {
+	now := time.Now()
+	l.sweep(now)
+
+	lock := l.entry(orderId)
+	defer lock.mu.Unlock()
+
+	if lock.held(now) {
+		return "", false, nil
+	}
+
+	// 锁已过期, 唤醒等待过期锁的请求
+	if lock.released != nil {
+		close(lock.released)
+	}
+
+	lock.token = newLockToken()
+	lock.expiresAt = now.Add(ttl)
+	lock.released = make(chan struct{})
+	return lock.token, true, nil
+}
+
+func (l *MemoryLocker) Renew(orderId, token string, ttl time.Duration) (bool, error) {
+	lock := l.load(orderId)
+	if lock == nil {
+		return false, nil
+	}
+	defer lock.mu.Unlock()
+
+	now := time.Now()
+	if lock.token != token || !lock.held(now) {
+		return false, nil
+	}
+
+	lock.expiresAt = now.Add(ttl)
+	return true, nil
+}
+
+func (l *MemoryLocker) Release(orderId, token string) error {
+	lock := l.load(orderId)
+	if lock == nil {
+		return nil
+	}
+	defer lock.mu.Unlock()
+
+	if lock.token == token {
+		l.remove(orderId, lock)
+	}
+	return nil
+}
+
+func (l *MemoryLocker) waitUnlock(orderId string, d time.Duration) {
+	lock := l.load(orderId)
+	if lock == nil {
+		return
+	}
+
+	var released chan struct{}
+	if lock.held(time.Now()) {
+		released = lock.released
+		// 锁过期时不会关闭released, 最多等到过期时间
+		if until := time.Until(lock.expiresAt); until < d {
+			d = until
+		}
+	}
+	lock.mu.Unlock()
+
+	if released == nil || d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-released:
+	case <-timer.C:
+	}
+}
+
+// Lock 兼容Locker, 使用DefaultLockTTL
+func (l *MemoryLocker) Lock(orderId string) (bool, error) {
+	_, ok, err := l.TryLock(orderId, DefaultLockTTL)
+	return ok, err
+}
+
+// UnLock 兼容Locker, 不校验持有者
+func (l *MemoryLocker) UnLock(orderId string) error {
+	lock := l.load(orderId)
+	if lock == nil {
+		return nil
+	}
+	defer lock.mu.Unlock()
+
+	l.remove(orderId, lock)
+	return nil
+}
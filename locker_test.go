@@ -0,0 +1,172 @@
+package unipay
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLocker 只实现Locker的锁
+type testLocker struct {
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func (l *testLocker) Lock(orderId string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locked[orderId] {
+		return false, nil
+	}
+	l.locked[orderId] = true
+	return true, nil
+}
+
+func (l *testLocker) UnLock(orderId string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.locked, orderId)
+	return nil
+}
+
+func TestMemoryLocker(t *testing.T) {
+	l := NewMemoryLocker()
+
+	token, ok, err := l.TryLock("o1", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("lock: %v %v", ok, err)
+	}
+	if _, ok, _ := l.TryLock("o1", time.Minute); ok {
+		t.Fatal("lock twice")
+	}
+	if _, ok, _ := l.TryLock("o2", time.Minute); !ok {
+		t.Fatal("other key blocked")
+	}
+
+	if ok, _ := l.Renew("o1", "other", time.Minute); ok {
+		t.Fatal("renew with other token")
+	}
+	if ok, _ := l.Renew("o1", token, time.Minute); !ok {
+		t.Fatal("renew")
+	}
+
+	// token不匹配时不释放
+	l.Release("o1", "other")
+	if _, ok, _ := l.TryLock("o1", time.Minute); ok {
+		t.Fatal("released by other token")
+	}
+	l.Release("o1", token)
+	if _, ok, _ := l.TryLock("o1", time.Minute); !ok {
+		t.Fatal("lock after release")
+	}
+
+	// 过期后可以重新获取, 原持有者不能续期
+	token, _, _ = l.TryLock("o3", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if _, ok, _ := l.TryLock("o3", time.Minute); !ok {
+		t.Fatal("lock after expiry")
+	}
+	if ok, _ := l.Renew("o3", token, time.Minute); ok {
+		t.Fatal("renew expired lock")
+	}
+}
+
+func TestMemoryLockerSweep(t *testing.T) {
+	l := NewMemoryLocker()
+	l.TryLock("expired", time.Millisecond)
+	l.TryLock("held", time.Minute)
+	time.Sleep(2 * time.Millisecond)
+
+	l.sweepedAt = time.Time{}
+	l.TryLock("other", time.Minute)
+
+	if _, ok := l.locks.Load("expired"); ok {
+		t.Fatal("expired lock not swept")
+	}
+	if _, ok := l.locks.Load("held"); !ok {
+		t.Fatal("held lock swept")
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	tests := []struct {
+		name   string
+		locker Locker
+	}{
+		{"memory", NewMemoryLocker()},
+		{"v1", &testLocker{locked: make(map[string]bool)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release, err := AcquireLock(tt.locker, "o1", LockOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := AcquireLock(tt.locker, "o1", LockOptions{}); !errors.Is(err, ErrConcurrentProcessing) {
+				t.Fatalf("got %v", err)
+			}
+			if _, err := AcquireLock(tt.locker, "o1", LockOptions{Wait: 20 * time.Millisecond}); !errors.Is(err, ErrConcurrentProcessing) {
+				t.Fatalf("wait: %v", err)
+			}
+
+			// release可以重复调用
+			release()
+			release()
+			release, err = AcquireLock(tt.locker, "o1", LockOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+		})
+	}
+
+	if release, err := AcquireLock(nil, "o1", LockOptions{}); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+}
+
+func TestAcquireLockWait(t *testing.T) {
+	l := NewMemoryLocker()
+
+	var (
+		wg      sync.WaitGroup
+		holding int32
+		overlap int32
+	)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// 过小的TTL按最小值处理, 不影响续期
+			release, err := AcquireLock(l, "o1", LockOptions{TTL: time.Nanosecond, Wait: 5 * time.Second})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if atomic.AddInt32(&holding, 1) > 1 {
+				atomic.StoreInt32(&overlap, 1)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&holding, -1)
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if overlap != 0 {
+		t.Fatal("lock held concurrently")
+	}
+	// 释放时唤醒等待者, 不需要按重试间隔轮询
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("took %s", d)
+	}
+}
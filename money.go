@@ -0,0 +1,140 @@
+package unipay
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencyExponents ISO 4217中小数位数不为2的货币, 未列出的货币小数位数为2
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0,
+	"KMF": 0, "KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0,
+	"VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// CurrencyExponent 货币的小数位数, 即最小单位与主单位的换算指数, 如CNY为2, JPY为0, KWD为3
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// Money 金额, Amount以货币的最小单位计, 如CNY为分, JPY为円, KWD为fils
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// NewMoney 以最小单位创建金额
+func NewMoney(amount int64, currency string) Money {
+	return Money{
+		Amount:   amount,
+		Currency: strings.ToUpper(currency),
+	}
+}
+
+// ParseMoney 解析第三方支付返回的十进制金额, 如"10.00", "1000", "1.500"
+// 小数位数超过货币的小数位数时, 超出的部分必须为0
+func ParseMoney(value, currency string) (Money, error) {
+	m := NewMoney(0, currency)
+	exp := m.Exponent()
+
+	s := value
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+
+	if intPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return m, errors.New("unipay: invalid money: " + value)
+	}
+
+	if len(fracPart) > exp {
+		if strings.Trim(fracPart[exp:], "0") != "" {
+			return m, errors.New("unipay: invalid money precision: " + value + " " + m.Currency)
+		}
+		fracPart = fracPart[:exp]
+	}
+	fracPart += strings.Repeat("0", exp-len(fracPart))
+
+	amount, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return m, errors.New("unipay: invalid money: " + value)
+	}
+
+	if neg {
+		amount = -amount
+	}
+	m.Amount = amount
+	return m, nil
+}
+
+// Exponent 货币的小数位数
+func (m Money) Exponent() int {
+	return CurrencyExponent(m.Currency)
+}
+
+// String 格式化为十进制金额, 不带货币单位, 如CNY 1000为"10.00", JPY 1000为"1000"
+func (m Money) String() string {
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	s := strconv.FormatInt(amount, 10)
+	exp := m.Exponent()
+	if exp == 0 {
+		return sign + s
+	}
+
+	if len(s) <= exp {
+		s = strings.Repeat("0", exp-len(s)+1) + s
+	}
+	return sign + s[:len(s)-exp] + "." + s[len(s)-exp:]
+}
+
+// Equal 金额和币种都相同, 币种不区分大小写
+func (m Money) Equal(o Money) bool {
+	return m.Amount == o.Amount && strings.EqualFold(m.Currency, o.Currency)
+}
+
+// Cmp 比较金额大小, m < o 返回-1, m == o 返回0, m > o 返回1, 币种不同时返回错误
+func (m Money) Cmp(o Money) (int, error) {
+	if !strings.EqualFold(m.Currency, o.Currency) {
+		return 0, fmt.Errorf("%w: currency %s %s", ErrAmountMismatch, m.Currency, o.Currency)
+	}
+
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Money 订单金额
+func (info *OrderInfo) Money() Money {
+	return NewMoney(int64(info.TotalFee), info.Currency)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package unipay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		value    string
+		currency string
+		amount   int64
+		ok       bool
+	}{
+		{"10.00", "CNY", 1000, true},
+		{"10", "cny", 1000, true},
+		{"10.5", "USD", 1050, true},
+		{"0.01", "USD", 1, true},
+		{"10.500", "USD", 1050, true},
+		{"-1.23", "USD", -123, true},
+		{"1000", "JPY", 1000, true},
+		{"1000.00", "JPY", 1000, true},
+		{"1.500", "KWD", 1500, true},
+		{"1.5", "KWD", 1500, true},
+		{"10.001", "USD", 0, false},
+		{"1000.5", "JPY", 0, false},
+		{"", "USD", 0, false},
+		{".5", "USD", 0, false},
+		{"1.2.3", "USD", 0, false},
+		{"1,000.00", "USD", 0, false},
+		{"1e3", "USD", 0, false},
+		{"99999999999999999999", "USD", 0, false},
+	}
+
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.value, tt.currency)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("ParseMoney(%q, %s) = %+v, want error", tt.value, tt.currency, m)
+			}
+			continue
+		}
+		if err != nil || m.Amount != tt.amount {
+			t.Errorf("ParseMoney(%q, %s) = %+v, %v, want %d", tt.value, tt.currency, m, err, tt.amount)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{NewMoney(1000, "CNY"), "10.00"},
+		{NewMoney(1, "USD"), "0.01"},
+		{NewMoney(0, "USD"), "0.00"},
+		{NewMoney(-5, "USD"), "-0.05"},
+		{NewMoney(1000, "JPY"), "1000"},
+		{NewMoney(1500, "KWD"), "1.500"},
+		{NewMoney(15, "KWD"), "0.015"},
+	}
+
+	for _, tt := range tests {
+		got := tt.money.String()
+		if got != tt.want {
+			t.Errorf("%+v.String() = %s, want %s", tt.money, got, tt.want)
+		}
+
+		// 格式化后可以解析回相同的金额
+		m, err := ParseMoney(got, tt.money.Currency)
+		if err != nil || !m.Equal(tt.money) {
+			t.Errorf("ParseMoney(%s) = %+v, %v", got, m, err)
+		}
+	}
+}
+
+func TestMoneyCmp(t *testing.T) {
+	tests := []struct {
+		a, b Money
+		want int
+		err  error
+	}{
+		{NewMoney(100, "USD"), NewMoney(100, "usd"), 0, nil},
+		{NewMoney(99, "USD"), NewMoney(100, "USD"), -1, nil},
+		{NewMoney(101, "USD"), NewMoney(100, "USD"), 1, nil},
+		{NewMoney(100, "USD"), NewMoney(100, "CNY"), 0, ErrAmountMismatch},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.a.Cmp(tt.b)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("%+v.Cmp(%+v) = %d, %v", tt.a, tt.b, got, err)
+		}
+	}
+}
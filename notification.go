@@ -0,0 +1,344 @@
+package unipay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NotificationStatus 通知的处理结果
+type NotificationStatus string
+
+const (
+	NotificationReceived  NotificationStatus = "received"  // 已接收, 正在处理或处理时进程退出
+	NotificationProcessed NotificationStatus = "processed" // 处理成功, 重复的通知直接应答成功
+	NotificationFailed    NotificationStatus = "failed"    // 处理失败, 等待第三方重新通知或重放
+)
+
+// notificationRetention MemoryNotificationStore中处理成功的通知保留时间, 覆盖第三方支付的重试周期
+const notificationRetention = 7 * 24 * time.Hour
+
+// notificationSweepInterval MemoryNotificationStore清理过期通知的间隔
+const notificationSweepInterval = time.Hour
+
+// notificationProcessingTimeout 通知处于NotificationReceived状态超过该时间视为处理中断, 可以重新处理
+const notificationProcessingTimeout = 5 * time.Minute
+
+// Notification 第三方支付的异步通知
+type Notification struct {
+	PayWay    string             // 支付方式
+	ID        string             // 通知ID, 同一通知重复投递时不变
+	Type      string             // 通知类型, 如paypal event_type, wxpay TRANSACTION.SUCCESS
+	Header    http.Header        // 原始请求头, APIv3/webhook验签需要
+	Payload   []byte             // 原始报文, 用于重放
+	Status    NotificationStatus // 处理结果
+	Error     string             // 处理失败的原因
+	Attempts  int                // 处理次数
+	CreatedAt time.Time          // 首次接收时间
+	UpdatedAt time.Time          // 最近一次处理时间
+}
+
+// Request 根据原始报文重建通知请求, 用于重放, 如cli.Notify(n.Request())
+// 签名带时间戳的通知(如wxpay APIv3)超过有效期后重放会验签失败
+func (n *Notification) Request() *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(n.Payload))
+	req.Header = n.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	return req
+}
+
+// NotificationStore 记录通知及处理结果
+// 第三方支付至少投递一次, 同一通知可能重复通知, 各客户端配置后跳过已处理成功的通知
+type NotificationStore interface {
+	// Get 查询通知, 不存在时返回nil, nil
+	Get(payWay, id string) (*Notification, error)
+
+	// Save 保存通知, 已存在时覆盖
+	Save(n *Notification) error
+
+	// List 按接收时间返回指定状态的通知, 用于重放处理失败或未处理完成的通知
+	List(status NotificationStatus) ([]*Notification, error)
+}
+
+// NotificationClaimer 原子地认领通知, NotificationStore可选实现
+// 未实现时ProcessNotification先Get再Save, 并发投递同一通知时可能重复处理
+type NotificationClaimer interface {
+	// Claim 认领通知, 认领成功时将n保存为NotificationReceived并返回true
+	// 通知已处理成功时返回false; 其他请求正在处理时返回ErrConcurrentProcessing
+	Claim(n *Notification) (bool, error)
+}
+
+// claimNotification 根据已有记录判断能否认领通知, 可以认领时更新n的状态, 处理次数和时间
+func claimNotification(old, n *Notification) (bool, error) {
+	now := time.Now()
+	n.CreatedAt = now
+	if old != nil {
+		switch {
+		case old.Status == NotificationProcessed:
+			return false, nil
+		case old.Status == NotificationReceived && now.Sub(old.UpdatedAt) < notificationProcessingTimeout:
+			return false, fmt.Errorf("%w: notification %s", ErrConcurrentProcessing, n.ID)
+		}
+		n.CreatedAt = old.CreatedAt
+		n.Attempts = old.Attempts
+	}
+
+	n.Attempts++
+	n.Status = NotificationReceived
+	n.Error = ""
+	n.UpdatedAt = now
+	return true, nil
+}
+
+// ProcessNotification 通知去重: 已处理成功的通知直接返回nil, 否则执行handle并记录处理结果
+// 处理前先保存原始报文, 进程在处理中退出时通知保持NotificationReceived状态, 可通过List找回
+// 同一通知正在处理时返回ErrConcurrentProcessing, 第三方会重新通知
+// store为nil或通知ID为空时直接执行handle
+func ProcessNotification(store NotificationStore, n *Notification, handle func() error) error {
+	if store == nil || n.ID == "" {
+		return handle()
+	}
+
+	var (
+		claimed bool
+		err     error
+	)
+	if claimer, ok := store.(NotificationClaimer); ok {
+		claimed, err = claimer.Claim(n)
+	} else {
+		var old *Notification
+		if old, err = store.Get(n.PayWay, n.ID); err == nil {
+			if claimed, err = claimNotification(old, n); claimed {
+				err = store.Save(n)
+			}
+		}
+	}
+	if err != nil || !claimed {
+		return err
+	}
+
+	if err := handle(); err != nil {
+		n.Status = NotificationFailed
+		n.Error = err.Error()
+		n.UpdatedAt = time.Now()
+		// 保存失败不影响返回处理错误, 第三方会重新通知
+		store.Save(n)
+		return err
+	}
+
+	n.Status = NotificationProcessed
+	n.UpdatedAt = time.Now()
+	return store.Save(n)
+}
+
+// MemoryNotificationStore 进程内的NotificationStore, 处理成功的通知保留7天, 每小时清理一次
+type MemoryNotificationStore struct {
+	mu            sync.Mutex
+	notifications map[string]*Notification
+	sweepedAt     time.Time
+}
+
+func NewMemoryNotificationStore() *MemoryNotificationStore {
+	return &MemoryNotificationStore{notifications: make(map[string]*Notification), sweepedAt: time.Now()}
+}
+
+// sweep 清理超过保留时间的已处理通知, 调用方需持有s.mu
+func (s *MemoryNotificationStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.sweepedAt) < notificationSweepInterval {
+		return
+	}
+	s.sweepedAt = now
+
+	for key, e := range s.notifications {
+		if e.Status == NotificationProcessed && now.Sub(e.UpdatedAt) > notificationRetention {
+			delete(s.notifications, key)
+		}
+	}
+}
+
+func (s *MemoryNotificationStore) Get(payWay, id string) (*Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notifications[payWay+"/"+id]
+	if !ok {
+		return nil, nil
+	}
+
+	c := *n
+	return &c, nil
+}
+
+func (s *MemoryNotificationStore) Save(n *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+
+	c := *n
+	s.notifications[n.PayWay+"/"+n.ID] = &c
+	return nil
+}
+
+func (s *MemoryNotificationStore) Claim(n *Notification) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+
+	ok, err := claimNotification(s.notifications[n.PayWay+"/"+n.ID], n)
+	if ok {
+		c := *n
+		s.notifications[n.PayWay+"/"+n.ID] = &c
+	}
+	return ok, err
+}
+
+func (s *MemoryNotificationStore) List(status NotificationStatus) ([]*Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*Notification
+	for _, n := range s.notifications {
+		if n.Status == status {
+			c := *n
+			list = append(list, &c)
+		}
+	}
+
+	sortNotifications(list)
+	return list, nil
+}
+
+// FileNotificationStore 基于本地文件的NotificationStore, 每个通知保存为Dir/PayWay/ID.json
+// 不会自动清理, 适用于单机部署或作为自定义实现的参考
+type FileNotificationStore struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+func NewFileNotificationStore(dir string) *FileNotificationStore {
+	return &FileNotificationStore{Dir: dir}
+}
+
+func (s *FileNotificationStore) path(payWay, id string) string {
+	return filepath.Join(s.Dir, url.PathEscape(payWay), url.PathEscape(id)+".json")
+}
+
+func (s *FileNotificationStore) Get(payWay, id string) (*Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := readNotification(s.path(payWay, id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return n, err
+}
+
+func (s *FileNotificationStore) Save(n *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save(n)
+}
+
+// Claim 进程内原子, 多进程共享目录时不能保证
+func (s *FileNotificationStore) Claim(n *Notification) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, err := readNotification(s.path(n.PayWay, n.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	ok, err := claimNotification(old, n)
+	if !ok {
+		return false, err
+	}
+	return true, s.save(n)
+}
+
+func (s *FileNotificationStore) save(n *Notification) error {
+	path := s.path(n.PayWay, n.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再重命名, 避免进程退出时留下不完整的文件
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".notification-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileNotificationStore) List(status NotificationStatus) ([]*Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Notification
+	for _, path := range paths {
+		n, err := readNotification(path)
+		if err != nil {
+			return nil, err
+		}
+		if n.Status == status {
+			list = append(list, n)
+		}
+	}
+
+	sortNotifications(list)
+	return list, nil
+}
+
+func readNotification(path string) (*Notification, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var n Notification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func sortNotifications(list []*Notification) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+}
@@ -0,0 +1,150 @@
+package unipay
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// getSaveStore 未实现NotificationClaimer, ProcessNotification使用Get/Save
+type getSaveStore struct {
+	store *MemoryNotificationStore
+}
+
+func (s getSaveStore) Get(payWay, id string) (*Notification, error) {
+	return s.store.Get(payWay, id)
+}
+
+func (s getSaveStore) Save(n *Notification) error {
+	return s.store.Save(n)
+}
+
+func (s getSaveStore) List(status NotificationStatus) ([]*Notification, error) {
+	return s.store.List(status)
+}
+
+func TestProcessNotification(t *testing.T) {
+	tests := []struct {
+		name  string
+		store func(t *testing.T) NotificationStore
+	}{
+		{"memory", func(t *testing.T) NotificationStore { return NewMemoryNotificationStore() }},
+		{"file", func(t *testing.T) NotificationStore { return NewFileNotificationStore(t.TempDir()) }},
+		{"get save", func(t *testing.T) NotificationStore { return getSaveStore{NewMemoryNotificationStore()} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := tt.store(t)
+			n := func() *Notification {
+				return &Notification{PayWay: PayWay_Paypal, ID: "WH-1", Type: "PAYMENT.CAPTURE.COMPLETED", Payload: []byte(`{}`)}
+			}
+
+			// 处理失败时记录原因, 重新通知时再次处理
+			failed := errors.New("failed")
+			if err := ProcessNotification(store, n(), func() error { return failed }); err != failed {
+				t.Fatalf("got %v", err)
+			}
+			list, err := store.List(NotificationFailed)
+			if err != nil || len(list) != 1 || list[0].Error != "failed" || list[0].Attempts != 1 {
+				t.Fatalf("failed list %+v, %v", list, err)
+			}
+
+			handled := 0
+			for i := 0; i < 2; i++ {
+				if err := ProcessNotification(store, n(), func() error { handled++; return nil }); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if handled != 1 {
+				t.Fatalf("handled %d", handled)
+			}
+
+			got, err := store.Get(PayWay_Paypal, "WH-1")
+			if err != nil || got.Status != NotificationProcessed || got.Attempts != 2 || string(got.Payload) != `{}` {
+				t.Fatalf("got %+v, %v", got, err)
+			}
+
+			// 通知ID为空时不去重
+			handled = 0
+			for i := 0; i < 2; i++ {
+				ProcessNotification(store, &Notification{PayWay: PayWay_Paypal}, func() error { handled++; return nil })
+			}
+			if handled != 2 {
+				t.Fatalf("handled without id %d", handled)
+			}
+		})
+	}
+}
+
+func TestProcessNotificationConcurrent(t *testing.T) {
+	stores := map[string]NotificationStore{
+		"memory": NewMemoryNotificationStore(),
+		"file":   NewFileNotificationStore(t.TempDir()),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			var (
+				wg      sync.WaitGroup
+				handled int32
+				busy    int32
+			)
+			start := make(chan struct{})
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+
+					err := ProcessNotification(store, &Notification{PayWay: PayWay_WxPay, ID: "4200000001"}, func() error {
+						atomic.AddInt32(&handled, 1)
+						time.Sleep(10 * time.Millisecond)
+						return nil
+					})
+					switch {
+					case err == nil:
+					case errors.Is(err, ErrConcurrentProcessing):
+						atomic.AddInt32(&busy, 1)
+					default:
+						t.Error(err)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			if handled != 1 {
+				t.Fatalf("handled %d, busy %d", handled, busy)
+			}
+		})
+	}
+}
+
+func TestProcessNotificationTimeout(t *testing.T) {
+	store := NewMemoryNotificationStore()
+
+	// 处理中断的通知超过notificationProcessingTimeout后可以重新处理
+	store.Save(&Notification{
+		PayWay:    PayWay_AliPay,
+		ID:        "n1",
+		Status:    NotificationReceived,
+		Attempts:  1,
+		UpdatedAt: time.Now().Add(-notificationProcessingTimeout),
+	})
+
+	handled := false
+	if err := ProcessNotification(store, &Notification{PayWay: PayWay_AliPay, ID: "n1"}, func() error {
+		handled = true
+		return nil
+	}); err != nil || !handled {
+		t.Fatalf("handled %v, %v", handled, err)
+	}
+
+	n, _ := store.Get(PayWay_AliPay, "n1")
+	if n.Attempts != 2 || n.Status != NotificationProcessed {
+		t.Fatalf("got %+v", n)
+	}
+}
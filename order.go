@@ -1,12 +1,15 @@
 package unipay
 
+import "time"
+
 type OrderInfo struct {
-	Subject    string // 购买项目
-	TotalFee   int    // 订单金额x100
-	OutTradeNo string // 应用内交易流水号
-	TradeNo    string // 第三方支付流水号
-	Attach     string // 透传参数
-	Currency   string // 货币单位, "CNY" | "USD"
+	Subject    string        // 购买项目
+	TotalFee   int           // 订单金额, 以Currency的最小单位计, 如CNY为分, JPY为円
+	OutTradeNo string        // 应用内交易流水号
+	TradeNo    string        // 第三方支付流水号
+	Attach     string        // 透传参数
+	Currency   string        // 货币单位, "CNY" | "USD"
+	Timeout    time.Duration // 订单超时关闭时间, 0表示使用第三方支付的默认值
 }
 
 type IOrder interface {
@@ -33,6 +36,20 @@ type IapOrderService interface {
 	CheckSubUser(ctx *Context, oriSubId, subId string) error
 }
 
+// PartialRefundService 部分退款处理接口, OrderService可选实现
+// 全额退款调用OrderService.Revoke, 部分退款时OrderService实现了该接口则调用PartialRefund, 否则忽略
+// 同一笔退款可能被重复通知, 实现方需要根据refundNo去重
+type PartialRefundService interface {
+	PartialRefund(order IOrder, refundNo string, refundFee int) error
+}
+
+// RefundedOrder 记录累计退款金额的订单, IOrder可选实现
+// 多笔部分退款累计达到订单金额时, 支付客户端据此调用OrderService.Revoke
+type RefundedOrder interface {
+	IOrder
+	RefundedFee() int
+}
+
 // Locker 订单锁, 防止并发处理同一笔订单导致而导致订单重复处理
 type Locker interface {
 	Lock(orderId string) (bool, error)
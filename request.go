@@ -26,6 +26,7 @@ type Request struct {
 	ProductID string `json:"goods_sn"`       // 商品编号,productID
 	Timestamp string `json:"timestamp"`      // 请求时间戳
 	Currency  string `json:"currency"`       // 货币单位
+	Nonce     string `json:"nonce"`          // 请求随机串, 用于防重放
 	Sign      string `json:"sign"`           // 请求签名
 
 	Attach string `json:"-"` // 附件信息
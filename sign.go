@@ -0,0 +1,228 @@
+package unipay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSkew 请求时间戳与服务器时间允许的默认最大偏差
+const DefaultMaxSkew = 5 * time.Minute
+
+// NonceCache 记录已使用的nonce, 防止请求被重放; 多实例部署时需要使用共享的实现
+type NonceCache interface {
+	// Add 记录nonce, ttl内已存在时返回false
+	Add(nonce string, ttl time.Duration) (bool, error)
+}
+
+// RequestSigner 校验客户端提交的支付请求(Request)的签名和时间戳
+// 签名串为参与签名的非空字段按key=value以&连接, value按url.QueryEscape转义, 使用HMAC计算后以小写hex编码
+// 默认所有字段按字段名升序参与签名, 字段名为Request的json tag, 如goods_sn, pay_way, timestamp
+type RequestSigner struct {
+	key     []byte
+	hash    func() hash.Hash
+	fields  []string
+	maxSkew time.Duration
+	nonces  NonceCache
+}
+
+type RequestSignerOption func(*RequestSigner)
+
+func NewRequestSigner(key []byte, opts ...RequestSignerOption) *RequestSigner {
+	s := &RequestSigner{
+		key:     key,
+		hash:    sha256.New,
+		maxSkew: DefaultMaxSkew,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.nonces == nil {
+		s.nonces = NewMemoryNonceCache()
+	}
+	return s
+}
+
+// SignHash HMAC使用的哈希算法, 默认sha256.New
+func SignHash(h func() hash.Hash) RequestSignerOption {
+	return func(s *RequestSigner) {
+		s.hash = h
+	}
+}
+
+// SignFields 参与签名的字段及顺序, 未列出的字段不参与签名
+// timestamp和nonce始终参与签名, 未列出时依次追加在最后
+func SignFields(fields ...string) RequestSignerOption {
+	return func(s *RequestSigner) {
+		s.fields = fields
+	}
+}
+
+// MaxSkew 时间戳允许的最大偏差, 默认DefaultMaxSkew
+func MaxSkew(d time.Duration) RequestSignerOption {
+	return func(s *RequestSigner) {
+		s.maxSkew = d
+	}
+}
+
+// WithNonceCache 防重放的nonce缓存, 默认进程内的MemoryNonceCache
+func WithNonceCache(cache NonceCache) RequestSignerOption {
+	return func(s *RequestSigner) {
+		s.nonces = cache
+	}
+}
+
+// requestFields 可参与签名的请求字段, key为json tag
+func requestFields(req *Request) map[string]string {
+	fields := map[string]string{
+		"receipt-data":            req.ReceiptData,
+		"purchase_data":           req.PurchaseData,
+		"purchase_data_sign":      req.PurchaseDataSign,
+		"transaction_id":          req.TransactionId,
+		"original_transaction_id": req.OriginalTransactionID,
+		"goods_sn":                req.ProductID,
+		"timestamp":               req.Timestamp,
+		"currency":                req.Currency,
+		"nonce":                   req.Nonce,
+		"attach":                  req.Attach,
+	}
+	if req.PayWay != 0 {
+		fields["pay_way"] = strconv.Itoa(int(req.PayWay))
+	}
+	return fields
+}
+
+// signKeys 参与签名的字段, 时间戳和nonce不签名时可以绕过过期和重放校验
+func (s *RequestSigner) signKeys(fields map[string]string) []string {
+	if len(s.fields) == 0 {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	keys := append([]string(nil), s.fields...)
+	for _, required := range []string{"timestamp", "nonce"} {
+		found := false
+		for _, k := range keys {
+			if k == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			keys = append(keys, required)
+		}
+	}
+	return keys
+}
+
+// SignString 签名串, value转义后字段之间不能互相移动内容
+func (s *RequestSigner) SignString(req *Request) string {
+	fields := requestFields(req)
+	keys := s.signKeys(fields)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if v := fields[k]; v != "" {
+			parts = append(parts, k+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Sign 计算请求签名
+func (s *RequestSigner) Sign(req *Request) string {
+	mac := hmac.New(s.hash, s.key)
+	mac.Write([]byte(s.SignString(req)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 校验时间戳, 签名和nonce, s为nil时不做校验
+// 时间戳为秒或毫秒; nonce为空时以签名作为nonce, 同一请求在时间戳有效期内只能提交一次
+func (s *RequestSigner) Verify(req *Request) error {
+	if s == nil {
+		return nil
+	}
+
+	ts, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp", ErrSignatureInvalid)
+	}
+
+	t := time.Unix(ts, 0)
+	if len(req.Timestamp) >= 13 {
+		t = time.UnixMilli(ts)
+	}
+	if d := time.Since(t); d > s.maxSkew || d < -s.maxSkew {
+		return fmt.Errorf("%w: timestamp expired", ErrSignatureInvalid)
+	}
+
+	if !hmac.Equal([]byte(strings.ToLower(req.Sign)), []byte(s.Sign(req))) {
+		return fmt.Errorf("%w: request", ErrSignatureInvalid)
+	}
+
+	nonce := req.Nonce
+	if nonce == "" {
+		nonce = req.Sign
+	}
+
+	// 超过时间戳有效期的请求已无法通过校验, nonce只需要保留2倍的最大偏差
+	ok, err := s.nonces.Add(nonce, 2*s.maxSkew)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrRequestReplayed, nonce)
+	}
+
+	return nil
+}
+
+// nonceSweepInterval MemoryNonceCache清理过期nonce的间隔
+const nonceSweepInterval = time.Minute
+
+// MemoryNonceCache 进程内的NonceCache, 过期的nonce每分钟清理一次
+type MemoryNonceCache struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	sweepedAt time.Time
+}
+
+func NewMemoryNonceCache() *MemoryNonceCache {
+	return &MemoryNonceCache{nonces: make(map[string]time.Time), sweepedAt: time.Now()}
+}
+
+func (c *MemoryNonceCache) Add(nonce string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.sweepedAt) >= nonceSweepInterval {
+		c.sweepedAt = now
+		for n, expiresAt := range c.nonces {
+			if !now.Before(expiresAt) {
+				delete(c.nonces, n)
+			}
+		}
+	}
+
+	if expiresAt, ok := c.nonces[nonce]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+
+	c.nonces[nonce] = now.Add(ttl)
+	return true, nil
+}
@@ -0,0 +1,143 @@
+package unipay
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedRequest(s *RequestSigner, ts time.Time, nonce string) *Request {
+	req := &Request{
+		PayWay:    3,
+		ProductID: "vip_month",
+		Timestamp: strconv.FormatInt(ts.Unix(), 10),
+		Nonce:     nonce,
+		Attach:    `{"channel":"test"}`,
+	}
+	req.Sign = s.Sign(req)
+	return req
+}
+
+func TestRequestSignerVerify(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		req  func(s *RequestSigner) *Request
+		err  error
+	}{
+		{"ok", func(s *RequestSigner) *Request {
+			return signedRequest(s, now, "n1")
+		}, nil},
+		{"millisecond timestamp", func(s *RequestSigner) *Request {
+			req := signedRequest(s, now, "n1")
+			req.Timestamp = strconv.FormatInt(now.UnixMilli(), 10)
+			req.Sign = s.Sign(req)
+			return req
+		}, nil},
+		{"expired", func(s *RequestSigner) *Request {
+			return signedRequest(s, now.Add(-10*time.Minute), "n1")
+		}, ErrSignatureInvalid},
+		{"future", func(s *RequestSigner) *Request {
+			return signedRequest(s, now.Add(10*time.Minute), "n1")
+		}, ErrSignatureInvalid},
+		{"invalid timestamp", func(s *RequestSigner) *Request {
+			req := signedRequest(s, now, "n1")
+			req.Timestamp = "yesterday"
+			req.Sign = s.Sign(req)
+			return req
+		}, ErrSignatureInvalid},
+		{"bad signature", func(s *RequestSigner) *Request {
+			req := signedRequest(s, now, "n1")
+			req.ProductID = "vip_year"
+			return req
+		}, ErrSignatureInvalid},
+		{"wrong key", func(s *RequestSigner) *Request {
+			return signedRequest(NewRequestSigner([]byte("other")), now, "n1")
+		}, ErrSignatureInvalid},
+		{"uppercase signature", func(s *RequestSigner) *Request {
+			req := signedRequest(s, now, "n1")
+			req.Sign = strings.ToUpper(req.Sign)
+			return req
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewRequestSigner(key)
+			err := s.Verify(tt.req(s))
+			if tt.err == nil && err != nil || !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRequestSignerReplay(t *testing.T) {
+	s := NewRequestSigner([]byte("secret"))
+	now := time.Now()
+
+	req := signedRequest(s, now, "n1")
+	if err := s.Verify(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(req); !errors.Is(err, ErrRequestReplayed) {
+		t.Fatalf("replay: %v", err)
+	}
+
+	// nonce为空时以签名作为nonce
+	req = signedRequest(s, now, "")
+	if err := s.Verify(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(req); !errors.Is(err, ErrRequestReplayed) {
+		t.Fatalf("replay without nonce: %v", err)
+	}
+
+	var nilSigner *RequestSigner
+	if err := nilSigner.Verify(&Request{}); err != nil {
+		t.Fatalf("nil signer: %v", err)
+	}
+}
+
+func TestRequestSignerSignString(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []RequestSignerOption
+		req    Request
+		expect string
+	}{
+		{"sorted", nil,
+			Request{PayWay: 3, ProductID: "g1", Timestamp: "1700000000", Nonce: "n1"},
+			"goods_sn=g1&nonce=n1&pay_way=3&timestamp=1700000000"},
+		{"escaped", nil,
+			Request{Timestamp: "1700000000", Attach: "x&currency=USD"},
+			"attach=x%26currency%3DUSD&timestamp=1700000000"},
+		{"fields", []RequestSignerOption{SignFields("pay_way", "goods_sn")},
+			Request{PayWay: 3, ProductID: "g1", Timestamp: "1700000000", Nonce: "n1", Currency: "USD"},
+			"pay_way=3&goods_sn=g1&timestamp=1700000000&nonce=n1"},
+		{"fields with timestamp", []RequestSignerOption{SignFields("timestamp", "goods_sn")},
+			Request{ProductID: "g1", Timestamp: "1700000000", Nonce: "n1"},
+			"timestamp=1700000000&goods_sn=g1&nonce=n1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewRequestSigner([]byte("secret"), tt.opts...)
+			if got := s.SignString(&tt.req); got != tt.expect {
+				t.Fatalf("got %s, want %s", got, tt.expect)
+			}
+		})
+	}
+
+	// 字段之间移动内容后签名不同
+	s := NewRequestSigner([]byte("secret"))
+	a := &Request{Timestamp: "1700000000", Attach: "x&currency=USD"}
+	b := &Request{Timestamp: "1700000000", Attach: "x", Currency: "USD"}
+	if s.Sign(a) == s.Sign(b) {
+		t.Fatal("attach and currency share a signature")
+	}
+}
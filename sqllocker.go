@@ -0,0 +1,113 @@
+package unipay
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLLockerSchema SQLLocker使用的表, 表名可通过SQLLocker.Table修改
+const SQLLockerSchema = `CREATE TABLE IF NOT EXISTS unipay_locks (
+	lock_key   VARCHAR(128) NOT NULL PRIMARY KEY,
+	token      VARCHAR(64)  NOT NULL,
+	expires_at BIGINT       NOT NULL
+)`
+
+// SQLLocker 基于数据库行的LockerV2, 适用于多实例部署
+// 以lock_key主键的唯一约束保证互斥, 过期时间为毫秒时间戳, 各实例的时钟偏差需要远小于ttl
+// 只使用database/sql, 不依赖具体的数据库驱动
+type SQLLocker struct {
+	DB *sql.DB
+
+	// Table 表名, 默认unipay_locks
+	Table string
+
+	// Dollar 占位符使用$1, $2..., 用于PostgreSQL; 默认使用?
+	Dollar bool
+}
+
+func NewSQLLocker(db *sql.DB) *SQLLocker {
+	return &SQLLocker{DB: db}
+}
+
+func (l *SQLLocker) table() string {
+	if l.Table == "" {
+		return "unipay_locks"
+	}
+	return l.Table
+}
+
+// query 替换语句中的表名和占位符
+func (l *SQLLocker) query(q string) string {
+	q = strings.ReplaceAll(q, "{table}", l.table())
+	if !l.Dollar {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (l *SQLLocker) TryLock(orderId string, ttl time.Duration) (string, bool, error) {
+	now := time.Now()
+
+	// 清理已过期的锁
+	_, err := l.DB.Exec(l.query("DELETE FROM {table} WHERE lock_key = ? AND expires_at <= ?"),
+		orderId, now.UnixMilli())
+	if err != nil {
+		return "", false, err
+	}
+
+	token := newLockToken()
+	_, err = l.DB.Exec(l.query("INSERT INTO {table} (lock_key, token, expires_at) VALUES (?, ?, ?)"),
+		orderId, token, now.Add(ttl).UnixMilli())
+	if err == nil {
+		return token, true, nil
+	}
+
+	// 不同驱动的唯一约束错误不同, 锁已存在时视为被其他持有者占用
+	var n int
+	if qerr := l.DB.QueryRow(l.query("SELECT COUNT(*) FROM {table} WHERE lock_key = ?"), orderId).Scan(&n); qerr == nil && n > 0 {
+		return "", false, nil
+	}
+	return "", false, err
+}
+
+func (l *SQLLocker) Renew(orderId, token string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := l.DB.Exec(l.query("UPDATE {table} SET expires_at = ? WHERE lock_key = ? AND token = ? AND expires_at > ?"),
+		now.Add(ttl).UnixMilli(), orderId, token, now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (l *SQLLocker) Release(orderId, token string) error {
+	_, err := l.DB.Exec(l.query("DELETE FROM {table} WHERE lock_key = ? AND token = ?"), orderId, token)
+	return err
+}
+
+// Lock 兼容Locker, 使用DefaultLockTTL
+func (l *SQLLocker) Lock(orderId string) (bool, error) {
+	_, ok, err := l.TryLock(orderId, DefaultLockTTL)
+	return ok, err
+}
+
+// UnLock 兼容Locker, 不校验持有者
+func (l *SQLLocker) UnLock(orderId string) error {
+	_, err := l.DB.Exec(l.query("DELETE FROM {table} WHERE lock_key = ?"), orderId)
+	return err
+}
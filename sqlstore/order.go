@@ -0,0 +1,41 @@
+package sqlstore
+
+import (
+	"time"
+
+	"github.com/lovewith99/unipay"
+)
+
+// Order 订单表中的订单, 实现unipay.IOrder, unipay.StatusOrder和unipay.RefundedOrder
+type Order struct {
+	Info       unipay.OrderInfo
+	PayWay     string // 支付方式, 如unipay.PayWay_WxPay
+	OriTradeNo string // 订阅的原始交易号, 续费订单与首期订单相同
+	ProductID  string // 商品编号
+	Uid        string // 用户id
+	RefundFee  int    // 累计退款金额, 以最小单位计
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+
+	status unipay.OrderStatus
+}
+
+// Payed 已支付, 包括部分退款的订单
+func (o *Order) Payed() bool {
+	return o.status == unipay.OrderStatusPaid || o.status == unipay.OrderStatusPartiallyRefunded
+}
+
+func (o *Order) OrderInfo() *unipay.OrderInfo {
+	return &o.Info
+}
+
+// RefundedFee 累计退款金额, 实现unipay.RefundedOrder
+func (o *Order) RefundedFee() int {
+	return o.RefundFee
+}
+
+// Status 订单状态, 实现unipay.StatusOrder
+// 状态只能通过Store的Invoke/Revoke/PartialRefund/Close按状态转换表修改
+func (o *Order) Status() unipay.OrderStatus {
+	return o.status
+}
@@ -0,0 +1,48 @@
+package sqlstore
+
+// Schema 建表语句, 表名前缀为unipay_, 自定义前缀时使用SchemaWithPrefix
+// 所有语句都可以重复执行, 见Store.Migrate; MySQL不支持CREATE INDEX IF NOT EXISTS, 需要去掉索引语句中的IF NOT EXISTS
+// 金额以货币的最小单位计, 时间为毫秒时间戳
+var Schema = schema("unipay_")
+
+func schema(prefix string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `orders (
+	out_trade_no VARCHAR(64)  NOT NULL PRIMARY KEY,
+	trade_no     VARCHAR(128) NOT NULL DEFAULT '',
+	ori_trade_no VARCHAR(128) NOT NULL DEFAULT '',
+	pay_way      VARCHAR(16)  NOT NULL,
+	product_id   VARCHAR(128) NOT NULL DEFAULT '',
+	uid          VARCHAR(64)  NOT NULL DEFAULT '',
+	subject      VARCHAR(256) NOT NULL DEFAULT '',
+	total_fee    BIGINT       NOT NULL,
+	refund_fee   BIGINT       NOT NULL DEFAULT 0,
+	currency     VARCHAR(8)   NOT NULL,
+	attach       TEXT         NOT NULL,
+	status       INTEGER      NOT NULL,
+	created_at   BIGINT       NOT NULL,
+	updated_at   BIGINT       NOT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS ` + prefix + `orders_trade_no ON ` + prefix + `orders (pay_way, trade_no)`,
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `order_events (
+	out_trade_no VARCHAR(64)  NOT NULL,
+	event        INTEGER      NOT NULL,
+	from_status  INTEGER      NOT NULL,
+	to_status    INTEGER      NOT NULL,
+	refund_no    VARCHAR(128) NOT NULL DEFAULT '',
+	amount       BIGINT       NOT NULL DEFAULT 0,
+	created_at   BIGINT       NOT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS ` + prefix + `order_events_out_trade_no ON ` + prefix + `order_events (out_trade_no)`,
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `attaches (
+	order_id   VARCHAR(128) NOT NULL PRIMARY KEY,
+	attach     TEXT         NOT NULL,
+	created_at BIGINT       NOT NULL
+)`,
+	}
+}
+
+// SchemaWithPrefix 使用自定义表名前缀的建表语句
+func SchemaWithPrefix(prefix string) []string {
+	return schema(prefix)
+}
@@ -0,0 +1,429 @@
+package sqlstore
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lovewith99/unipay"
+	"github.com/lovewith99/unipay/iap"
+)
+
+// NewOrderFunc 根据支付上下文创建订单, 需要设置PayWay和订单金额
+// OutTradeNo为空时自动生成; TradeNo/OriTradeNo为空时从ctx.InApp中获取(apple/google)
+// paypal订阅续费时ctx.InApp为*unipaypal.SubscriptionSale, 需要将TradeNo设置为sale.ID
+type NewOrderFunc func(ctx *unipay.Context) (*Order, error)
+
+// InvokeFunc 订单状态变更时的业务逻辑, 与状态更新在同一个事务中执行, 返回错误时回滚
+type InvokeFunc func(tx *sql.Tx, order *Order) error
+
+// PartialRefundFunc 部分退款的业务逻辑, 与状态更新在同一个事务中执行, 返回错误时回滚
+type PartialRefundFunc func(tx *sql.Tx, order *Order, refundNo string, refundFee int) error
+
+// Store 基于database/sql的订单存储, 实现unipay.IapOrderService, unipay.PartialRefundService和unipay.AttachService
+// 只使用标准库, 不依赖具体的数据库驱动, 表结构见Schema
+type Store struct {
+	db     *sql.DB
+	prefix string
+	dollar bool
+
+	newOrder      NewOrderFunc
+	invoke        InvokeFunc
+	revoke        InvokeFunc
+	partialRefund PartialRefundFunc
+	checkSubUser  func(ctx *unipay.Context, oriSubId, subId string) error
+}
+
+type Option func(*Store)
+
+func New(db *sql.DB, newOrder NewOrderFunc, opts ...Option) *Store {
+	s := &Store{
+		db:       db,
+		prefix:   "unipay_",
+		newOrder: newOrder,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// TablePrefix 表名前缀, 默认unipay_, 建表语句使用SchemaWithPrefix
+func TablePrefix(prefix string) Option {
+	return func(s *Store) {
+		s.prefix = prefix
+	}
+}
+
+// Dollar 占位符使用$1, $2..., 用于PostgreSQL; 默认使用?
+func Dollar() Option {
+	return func(s *Store) {
+		s.dollar = true
+	}
+}
+
+// WithInvoke 订单支付成功的业务逻辑, 如发放商品
+func WithInvoke(fn InvokeFunc) Option {
+	return func(s *Store) {
+		s.invoke = fn
+	}
+}
+
+// WithRevoke 订单全额退款/撤销的业务逻辑, 执行与Invoke相反的操作
+func WithRevoke(fn InvokeFunc) Option {
+	return func(s *Store) {
+		s.revoke = fn
+	}
+}
+
+// WithPartialRefund 部分退款的业务逻辑, 同一笔退款只会执行一次
+func WithPartialRefund(fn PartialRefundFunc) Option {
+	return func(s *Store) {
+		s.partialRefund = fn
+	}
+}
+
+// WithCheckSubUser 校验订阅续费的用户, 见unipay.IapOrderService
+func WithCheckSubUser(fn func(ctx *unipay.Context, oriSubId, subId string) error) Option {
+	return func(s *Store) {
+		s.checkSubUser = fn
+	}
+}
+
+// Migrate 使用Store的表名前缀执行建表语句, 表和索引已存在时跳过
+func (s *Store) Migrate() error {
+	for _, q := range SchemaWithPrefix(s.prefix) {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const orderColumns = "out_trade_no, trade_no, ori_trade_no, pay_way, product_id, uid, subject, " +
+	"total_fee, refund_fee, currency, attach, status, created_at, updated_at"
+
+// query 替换语句中的表名和占位符
+func (s *Store) query(q string) string {
+	q = strings.NewReplacer(
+		"{orders}", s.prefix+"orders",
+		"{order_events}", s.prefix+"order_events",
+		"{attaches}", s.prefix+"attaches",
+	).Replace(q)
+	if !s.dollar {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row scanner) (*Order, error) {
+	var o Order
+	var totalFee, refundFee, createdAt, updatedAt int64
+	var status int
+	err := row.Scan(&o.Info.OutTradeNo, &o.Info.TradeNo, &o.OriTradeNo, &o.PayWay, &o.ProductID, &o.Uid,
+		&o.Info.Subject, &totalFee, &refundFee, &o.Info.Currency, &o.Info.Attach, &status, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	o.Info.TotalFee = int(totalFee)
+	o.RefundFee = int(refundFee)
+	o.status = unipay.OrderStatus(status)
+	o.CreatedAt = time.UnixMilli(createdAt)
+	o.UpdatedAt = time.UnixMilli(updatedAt)
+	return &o, nil
+}
+
+// PostOrder 调用NewOrderFunc创建订单并保存, 订单状态为unipay.OrderStatusCreated
+func (s *Store) PostOrder(ctx *unipay.Context) (unipay.IOrder, error) {
+	order, err := s.newOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.PayWay == "" {
+		return nil, errors.New("sqlstore: pay way required")
+	}
+
+	info := &order.Info
+	if info.OutTradeNo == "" {
+		info.OutTradeNo = newTradeNo()
+	}
+	if ctx.InApp != nil {
+		no, orino := iap.GetTradeNo(ctx.InApp)
+		if info.TradeNo == "" {
+			info.TradeNo = no
+		}
+		if order.OriTradeNo == "" {
+			order.OriTradeNo = orino
+		}
+	}
+	if info.Currency == "" {
+		info.Currency = ctx.Currency
+	}
+	if order.ProductID == "" {
+		order.ProductID = ctx.ProductID
+	}
+	if order.Uid == "" && ctx.Uid != nil {
+		order.Uid = fmt.Sprint(ctx.Uid)
+	}
+	if info.Attach == "" {
+		info.Attach = ctx.Attach
+	}
+	if info.Attach == "" && info.TradeNo != "" {
+		// apple/google补单时attach可能只保存在AttachService中
+		if info.Attach, err = s.attach(info.TradeNo); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	order.status = unipay.OrderStatusCreated
+	order.CreatedAt = now
+	order.UpdatedAt = now
+
+	_, err = s.db.Exec(s.query("INSERT INTO {orders} ("+orderColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		info.OutTradeNo, info.TradeNo, order.OriTradeNo, order.PayWay, order.ProductID, order.Uid, info.Subject,
+		int64(info.TotalFee), int64(order.RefundFee), info.Currency, info.Attach, int(order.status),
+		now.UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// GetOrderByTradeNo 根据商户订单号或第三方交易流水号获取订单, 不存在时返回unipay.OrderNotFoundError
+// 先按商户订单号查询, 不存在时再按第三方交易号查询(apple/google, paypal订阅扣款); tradeno为空时返回错误
+func (s *Store) GetOrderByTradeNo(tradeno string, payway string) (unipay.IOrder, error) {
+	if tradeno == "" {
+		return nil, errors.New("sqlstore: trade no required")
+	}
+
+	row := s.db.QueryRow(s.query("SELECT "+orderColumns+" FROM {orders} WHERE out_trade_no = ? AND pay_way = ?"),
+		tradeno, payway)
+	order, err := scanOrder(row)
+	if err == nil {
+		return order, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// trade_no没有唯一约束, 多条时取最早创建的订单
+	rows, err := s.db.Query(s.query("SELECT "+orderColumns+" FROM {orders} WHERE pay_way = ? AND trade_no = ? ORDER BY created_at"),
+		payway, tradeno)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, unipay.OrderNotFoundError
+	}
+
+	return scanOrder(rows)
+}
+
+// GetOrder 根据商户订单号获取订单, 不存在时返回unipay.OrderNotFoundError
+func (s *Store) GetOrder(outTradeNo string) (*Order, error) {
+	row := s.db.QueryRow(s.query("SELECT "+orderColumns+" FROM {orders} WHERE out_trade_no = ?"), outTradeNo)
+
+	order, err := scanOrder(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, unipay.OrderNotFoundError
+	}
+	return order, err
+}
+
+// Invoke 订单支付成功, 状态更新为unipay.OrderStatusPaid并执行WithInvoke的业务逻辑
+func (s *Store) Invoke(order unipay.IOrder) error {
+	return s.transition(order, unipay.OrderEventPay, "", 0, s.invoke)
+}
+
+// Revoke 订单全额退款/撤销, 状态更新为unipay.OrderStatusRefunded并执行WithRevoke的业务逻辑
+func (s *Store) Revoke(order unipay.IOrder) error {
+	return s.transition(order, unipay.OrderEventRefund, "", 0, s.revoke)
+}
+
+// PartialRefund 部分退款, 状态更新为unipay.OrderStatusPartiallyRefunded并累计退款金额, 根据refundNo去重
+func (s *Store) PartialRefund(order unipay.IOrder, refundNo string, refundFee int) error {
+	var fn InvokeFunc
+	if s.partialRefund != nil {
+		fn = func(tx *sql.Tx, o *Order) error {
+			return s.partialRefund(tx, o, refundNo, refundFee)
+		}
+	}
+	return s.transition(order, unipay.OrderEventPartialRefund, refundNo, refundFee, fn)
+}
+
+// Close 关闭未支付的订单
+func (s *Store) Close(outTradeNo string) error {
+	order, err := s.GetOrder(outTradeNo)
+	if err != nil {
+		return err
+	}
+	return s.transition(order, unipay.OrderEventClose, "", 0, nil)
+}
+
+// CheckSubUser 校验订阅续费的用户, 未配置WithCheckSubUser时不做校验
+func (s *Store) CheckSubUser(ctx *unipay.Context, oriSubId, subId string) error {
+	if s.checkSubUser == nil {
+		return nil
+	}
+	return s.checkSubUser(ctx, oriSubId, subId)
+}
+
+// transition 按状态转换表更新订单状态并记录状态变更, 在同一个事务中执行业务逻辑
+// 订单状态以数据库为准, 并发修改同一笔订单时返回unipay.ErrConcurrentProcessing
+func (s *Store) transition(order unipay.IOrder, event unipay.OrderEvent, refundNo string, amount int, fn InvokeFunc) error {
+	o, err := s.GetOrder(order.OrderInfo().OutTradeNo)
+	if err != nil {
+		return err
+	}
+
+	next, err := unipay.Transition(o.status, event)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if refundNo != "" {
+		var n int
+		err := tx.QueryRow(s.query("SELECT COUNT(*) FROM {order_events} WHERE out_trade_no = ? AND refund_no = ?"),
+			o.Info.OutTradeNo, refundNo).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			// 重复的退款通知
+			return nil
+		}
+	}
+
+	refundFee := o.RefundFee + amount
+	if event == unipay.OrderEventRefund {
+		amount = o.Info.TotalFee - o.RefundFee
+		refundFee = o.Info.TotalFee
+	}
+
+	// 支付时保存调用方设置的第三方交易号, 如微信transaction_id, paypal订阅扣款的sale id
+	tradeNo := o.Info.TradeNo
+	if no := order.OrderInfo().TradeNo; event == unipay.OrderEventPay && no != "" {
+		tradeNo = no
+	}
+
+	now := time.Now()
+	res, err := tx.Exec(s.query("UPDATE {orders} SET status = ?, refund_fee = ?, trade_no = ?, updated_at = ? WHERE out_trade_no = ? AND status = ? AND refund_fee = ?"),
+		int(next), int64(refundFee), tradeNo, now.UnixMilli(), o.Info.OutTradeNo, int(o.status), int64(o.RefundFee))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// 订单状态已被其他请求修改
+		return fmt.Errorf("%w: %s", unipay.ErrConcurrentProcessing, o.Info.OutTradeNo)
+	}
+
+	_, err = tx.Exec(s.query("INSERT INTO {order_events} (out_trade_no, event, from_status, to_status, refund_no, amount, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"),
+		o.Info.OutTradeNo, int(event), int(o.status), int(next), refundNo, int64(amount), now.UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	o.status = next
+	o.RefundFee = refundFee
+	o.Info.TradeNo = tradeNo
+	o.UpdatedAt = now
+	if fn != nil {
+		if err := fn(tx, o); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// 同步调用方持有的订单
+	if so, ok := order.(*Order); ok && so != o {
+		*so = *o
+	}
+	return nil
+}
+
+// Create 保存订单的attach, 实现unipay.AttachService
+func (s *Store) Create(orderId, attach string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.query("DELETE FROM {attaches} WHERE order_id = ?"), orderId); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.query("INSERT INTO {attaches} (order_id, attach, created_at) VALUES (?, ?, ?)"),
+		orderId, attach, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete 删除订单的attach, 实现unipay.AttachService
+func (s *Store) Delete(orderId string) error {
+	_, err := s.db.Exec(s.query("DELETE FROM {attaches} WHERE order_id = ?"), orderId)
+	return err
+}
+
+func (s *Store) attach(orderId string) (string, error) {
+	var attach string
+	err := s.db.QueryRow(s.query("SELECT attach FROM {attaches} WHERE order_id = ?"), orderId).Scan(&attach)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return attach, err
+}
+
+// newTradeNo 生成商户订单号, 时间前缀加随机数, 长度26, 满足各支付方式的长度限制
+func newTradeNo() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return time.Now().Format("20060102150405") + hex.EncodeToString(b)
+}
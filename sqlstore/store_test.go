@@ -0,0 +1,263 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lovewith99/unipay"
+	_ "modernc.org/sqlite"
+)
+
+type testStore struct {
+	*Store
+	invoked  int32
+	revoked  int32
+	refunded int32
+	failNext bool
+}
+
+func newTestStore(t *testing.T) *testStore {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "unipay.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ts := &testStore{}
+	ts.Store = New(db,
+		func(ctx *unipay.Context) (*Order, error) {
+			return &Order{
+				PayWay: unipay.PayWay_WxPay,
+				Info:   unipay.OrderInfo{Subject: "VIP", TotalFee: 600},
+			}, nil
+		},
+		WithInvoke(func(tx *sql.Tx, order *Order) error {
+			atomic.AddInt32(&ts.invoked, 1)
+			return nil
+		}),
+		WithRevoke(func(tx *sql.Tx, order *Order) error {
+			if ts.failNext {
+				ts.failNext = false
+				return errors.New("revoke failed")
+			}
+			atomic.AddInt32(&ts.revoked, 1)
+			return nil
+		}),
+		WithPartialRefund(func(tx *sql.Tx, order *Order, refundNo string, refundFee int) error {
+			atomic.AddInt32(&ts.refunded, 1)
+			return nil
+		}),
+	)
+
+	// 重复执行建表语句
+	for i := 0; i < 2; i++ {
+		if err := ts.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ts
+}
+
+func (ts *testStore) postOrder(t *testing.T) *Order {
+	t.Helper()
+
+	ctx := unipay.PayContext(0)
+	ctx.ProductID = "vip_month"
+	ctx.Currency = "CNY"
+	ctx.Uid = 42
+	ctx.Attach = `{"channel":"test"}`
+
+	order, err := ts.PostOrder(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order.(*Order)
+}
+
+func TestPostOrder(t *testing.T) {
+	ts := newTestStore(t)
+	order := ts.postOrder(t)
+
+	info := order.OrderInfo()
+	if len(info.OutTradeNo) != 26 {
+		t.Fatalf("out_trade_no %q", info.OutTradeNo)
+	}
+	if order.Status() != unipay.OrderStatusCreated || order.Payed() {
+		t.Fatalf("status %s", order.Status())
+	}
+
+	got, err := ts.GetOrder(info.OutTradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PayWay != unipay.PayWay_WxPay || got.ProductID != "vip_month" || got.Uid != "42" ||
+		got.Info.Currency != "CNY" || got.Info.TotalFee != 600 || got.Info.Attach != `{"channel":"test"}` {
+		t.Fatalf("order %+v", got)
+	}
+}
+
+func TestGetOrderByTradeNo(t *testing.T) {
+	ts := newTestStore(t)
+	order := ts.postOrder(t)
+	other := ts.postOrder(t)
+	outTradeNo := order.OrderInfo().OutTradeNo
+
+	// trade_no默认为空, 空的交易号不能匹配任意订单
+	if _, err := ts.GetOrderByTradeNo("", unipay.PayWay_WxPay); err == nil || unipay.IsOrderNotFoundError(err) {
+		t.Fatalf("empty trade no: %v", err)
+	}
+
+	got, err := ts.GetOrderByTradeNo(outTradeNo, unipay.PayWay_WxPay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.OrderInfo().OutTradeNo != outTradeNo {
+		t.Fatalf("got %s", got.OrderInfo().OutTradeNo)
+	}
+
+	if _, err := ts.GetOrderByTradeNo(outTradeNo, unipay.PayWay_AliPay); !unipay.IsOrderNotFoundError(err) {
+		t.Fatalf("other pay way: %v", err)
+	}
+	if _, err := ts.GetOrderByTradeNo("unknown", unipay.PayWay_WxPay); !unipay.IsOrderNotFoundError(err) {
+		t.Fatalf("unknown: %v", err)
+	}
+
+	// 支付时保存第三方交易号
+	got.OrderInfo().TradeNo = "4200000001"
+	if err := ts.Invoke(got); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ts.GetOrderByTradeNo("4200000001", unipay.PayWay_WxPay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.OrderInfo().OutTradeNo != outTradeNo {
+		t.Fatalf("got %s, other %s", got.OrderInfo().OutTradeNo, other.OrderInfo().OutTradeNo)
+	}
+}
+
+func TestInvokeRevoke(t *testing.T) {
+	ts := newTestStore(t)
+	order := ts.postOrder(t)
+
+	if err := ts.Revoke(order); !errors.Is(err, unipay.ErrOrderNotPaid) {
+		t.Fatalf("revoke before pay: %v", err)
+	}
+
+	if err := ts.Invoke(order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Status() != unipay.OrderStatusPaid || !order.Payed() || ts.invoked != 1 {
+		t.Fatalf("status %s, invoked %d", order.Status(), ts.invoked)
+	}
+	if err := ts.Invoke(order); !errors.Is(err, unipay.ErrOrderPaid) {
+		t.Fatalf("invoke twice: %v", err)
+	}
+
+	// 业务逻辑失败时回滚
+	ts.failNext = true
+	if err := ts.Revoke(order); err == nil {
+		t.Fatal("revoke should fail")
+	}
+	got, err := ts.GetOrder(order.OrderInfo().OutTradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status() != unipay.OrderStatusPaid || got.RefundFee != 0 {
+		t.Fatalf("rollback: status %s, refund fee %d", got.Status(), got.RefundFee)
+	}
+
+	if err := ts.Revoke(order); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ts.GetOrder(order.OrderInfo().OutTradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status() != unipay.OrderStatusRefunded || got.RefundFee != 600 || got.Payed() || ts.revoked != 1 {
+		t.Fatalf("status %s, refund fee %d, revoked %d", got.Status(), got.RefundFee, ts.revoked)
+	}
+	if err := ts.Revoke(order); !errors.Is(err, unipay.ErrOrderRefunded) {
+		t.Fatalf("revoke twice: %v", err)
+	}
+}
+
+func TestPartialRefund(t *testing.T) {
+	ts := newTestStore(t)
+	order := ts.postOrder(t)
+	if err := ts.Invoke(order); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct {
+		refundNo string
+		fee      int
+	}{{"r1", 100}, {"r1", 100}, {"r2", 100}} {
+		if err := ts.PartialRefund(order, r.refundNo, r.fee); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := ts.GetOrder(order.OrderInfo().OutTradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status() != unipay.OrderStatusPartiallyRefunded || got.RefundedFee() != 200 || !got.Payed() || ts.refunded != 2 {
+		t.Fatalf("status %s, refund fee %d, refunded %d", got.Status(), got.RefundFee, ts.refunded)
+	}
+
+	// 部分退款累计达到订单金额后撤销订单
+	if err := ts.PartialRefund(got, "r3", 400); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Revoke(got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status() != unipay.OrderStatusRefunded || got.RefundedFee() != 600 || ts.revoked != 1 {
+		t.Fatalf("status %s, refund fee %d, revoked %d", got.Status(), got.RefundFee, ts.revoked)
+	}
+}
+
+func TestConcurrentInvoke(t *testing.T) {
+	ts := newTestStore(t)
+	order := ts.postOrder(t)
+	outTradeNo := order.OrderInfo().OutTradeNo
+
+	var (
+		wg sync.WaitGroup
+		ok int32
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			o, err := ts.GetOrderByTradeNo(outTradeNo, unipay.PayWay_WxPay)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			err = ts.Invoke(o)
+			switch {
+			case err == nil:
+				atomic.AddInt32(&ok, 1)
+			case errors.Is(err, unipay.ErrConcurrentProcessing), errors.Is(err, unipay.ErrOrderPaid):
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok != 1 || ts.invoked != 1 {
+		t.Fatalf("succeeded %d, invoked %d", ok, ts.invoked)
+	}
+}
@@ -0,0 +1,170 @@
+package unipay
+
+import (
+	"errors"
+	"strconv"
+)
+
+// OrderStatus 订单状态
+type OrderStatus int
+
+const (
+	OrderStatusCreated           OrderStatus = iota + 1 // 已创建, 等待支付
+	OrderStatusPending                                  // 支付处理中
+	OrderStatusPaid                                     // 已支付
+	OrderStatusPartiallyRefunded                        // 部分退款
+	OrderStatusRefunded                                 // 全额退款/已撤销
+	OrderStatusClosed                                   // 已关闭
+	OrderStatusFailed                                   // 支付失败
+)
+
+func (s OrderStatus) String() string {
+	switch s {
+	case OrderStatusCreated:
+		return "created"
+	case OrderStatusPending:
+		return "pending"
+	case OrderStatusPaid:
+		return "paid"
+	case OrderStatusPartiallyRefunded:
+		return "partially_refunded"
+	case OrderStatusRefunded:
+		return "refunded"
+	case OrderStatusClosed:
+		return "closed"
+	case OrderStatusFailed:
+		return "failed"
+	}
+	return "OrderStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// OrderEvent 订单事件, 驱动订单状态转换
+type OrderEvent int
+
+const (
+	OrderEventPay           OrderEvent = iota + 1 // 支付成功, 执行OrderService.Invoke
+	OrderEventRefund                              // 全额退款/撤销, 执行OrderService.Revoke
+	OrderEventPartialRefund                       // 部分退款, 执行PartialRefundService.PartialRefund
+	OrderEventClose                               // 关闭订单
+	OrderEventFail                                // 支付失败
+)
+
+func (e OrderEvent) String() string {
+	switch e {
+	case OrderEventPay:
+		return "pay"
+	case OrderEventRefund:
+		return "refund"
+	case OrderEventPartialRefund:
+		return "partial_refund"
+	case OrderEventClose:
+		return "close"
+	case OrderEventFail:
+		return "fail"
+	}
+	return "OrderEvent(" + strconv.Itoa(int(e)) + ")"
+}
+
+// StatusOrder 带状态的订单, IOrder可选实现
+// 未实现时根据Payed()推断状态: 已支付为OrderStatusPaid, 否则为OrderStatusCreated
+type StatusOrder interface {
+	IOrder
+	Status() OrderStatus
+}
+
+// 订单状态错误, 可通过errors.Is判断
+var (
+	ErrOrderPaid     = errors.New("order already paid")     // 订单已支付, 重复的支付通知
+	ErrOrderNotPaid  = errors.New("order not paid")         // 订单未支付, 不能退款
+	ErrOrderRefunded = errors.New("order already refunded") // 订单已全额退款, 重复退款
+	ErrOrderClosed   = errors.New("order closed")           // 订单已关闭, 不能支付
+)
+
+// OrderStateError 订单当前状态不允许执行事件
+type OrderStateError struct {
+	Status OrderStatus
+	Event  OrderEvent
+}
+
+func (e *OrderStateError) Error() string {
+	return "order status " + e.Status.String() + " does not allow " + e.Event.String()
+}
+
+// Unwrap 返回对应的订单状态错误, 如重复退款为ErrOrderRefunded
+func (e *OrderStateError) Unwrap() error {
+	switch e.Event {
+	case OrderEventPay:
+		if e.Status == OrderStatusClosed {
+			return ErrOrderClosed
+		}
+		return ErrOrderPaid
+	case OrderEventRefund, OrderEventPartialRefund:
+		if e.Status == OrderStatusRefunded {
+			return ErrOrderRefunded
+		}
+		return ErrOrderNotPaid
+	case OrderEventClose, OrderEventFail:
+		if e.Status == OrderStatusClosed {
+			return ErrOrderClosed
+		}
+		return ErrOrderPaid
+	}
+	return nil
+}
+
+// orderTransitions 订单状态转换表, 未列出的转换不允许
+var orderTransitions = map[OrderStatus]map[OrderEvent]OrderStatus{
+	OrderStatusCreated: {
+		OrderEventPay:   OrderStatusPaid,
+		OrderEventClose: OrderStatusClosed,
+		OrderEventFail:  OrderStatusFailed,
+	},
+	OrderStatusPending: {
+		OrderEventPay:   OrderStatusPaid,
+		OrderEventClose: OrderStatusClosed,
+		OrderEventFail:  OrderStatusFailed,
+	},
+	OrderStatusFailed: {
+		OrderEventPay:   OrderStatusPaid,
+		OrderEventClose: OrderStatusClosed,
+	},
+	OrderStatusPaid: {
+		OrderEventRefund:        OrderStatusRefunded,
+		OrderEventPartialRefund: OrderStatusPartiallyRefunded,
+	},
+	OrderStatusPartiallyRefunded: {
+		OrderEventRefund:        OrderStatusRefunded,
+		OrderEventPartialRefund: OrderStatusPartiallyRefunded,
+	},
+}
+
+// Transition 根据状态转换表返回执行事件后的状态, 不允许时返回*OrderStateError
+func Transition(status OrderStatus, event OrderEvent) (OrderStatus, error) {
+	if next, ok := orderTransitions[status][event]; ok {
+		return next, nil
+	}
+	return status, &OrderStateError{Status: status, Event: event}
+}
+
+// StatusOf 订单当前状态
+func StatusOf(order IOrder) OrderStatus {
+	if so, ok := order.(StatusOrder); ok {
+		return so.Status()
+	}
+
+	if order.Payed() {
+		return OrderStatusPaid
+	}
+	return OrderStatusCreated
+}
+
+// CheckTransition 校验订单当前状态能否执行事件
+func CheckTransition(order IOrder, event OrderEvent) error {
+	_, err := Transition(StatusOf(order), event)
+	return err
+}
+
+// IsProcessed 事件已处理过, 如重复的支付/退款通知, 调用方可直接忽略
+func IsProcessed(err error) bool {
+	return errors.Is(err, ErrOrderPaid) || errors.Is(err, ErrOrderRefunded)
+}
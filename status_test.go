@@ -0,0 +1,88 @@
+package unipay
+
+import (
+	"errors"
+	"testing"
+)
+
+type testOrder struct {
+	payed  bool
+	status OrderStatus
+}
+
+func (o *testOrder) Payed() bool           { return o.payed }
+func (o *testOrder) OrderInfo() *OrderInfo { return &OrderInfo{} }
+
+type testStatusOrder struct {
+	testOrder
+}
+
+func (o *testStatusOrder) Status() OrderStatus { return o.status }
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     IOrder
+		event     OrderEvent
+		err       error
+		processed bool
+	}{
+		{"pay created", &testOrder{}, OrderEventPay, nil, false},
+		{"pay paid", &testOrder{payed: true}, OrderEventPay, ErrOrderPaid, true},
+		{"refund unpaid", &testOrder{}, OrderEventRefund, ErrOrderNotPaid, false},
+		{"refund paid", &testOrder{payed: true}, OrderEventRefund, nil, false},
+		{"partial refund unpaid", &testOrder{}, OrderEventPartialRefund, ErrOrderNotPaid, false},
+		{"pay pending", &testStatusOrder{testOrder{status: OrderStatusPending}}, OrderEventPay, nil, false},
+		{"pay failed", &testStatusOrder{testOrder{status: OrderStatusFailed}}, OrderEventPay, nil, false},
+		{"pay closed", &testStatusOrder{testOrder{status: OrderStatusClosed}}, OrderEventPay, ErrOrderClosed, false},
+		{"pay refunded", &testStatusOrder{testOrder{status: OrderStatusRefunded}}, OrderEventPay, ErrOrderPaid, true},
+		{"refund refunded", &testStatusOrder{testOrder{status: OrderStatusRefunded}}, OrderEventRefund, ErrOrderRefunded, true},
+		{"partial refund refunded", &testStatusOrder{testOrder{status: OrderStatusRefunded}}, OrderEventPartialRefund, ErrOrderRefunded, true},
+		{"refund partially refunded", &testStatusOrder{testOrder{status: OrderStatusPartiallyRefunded}}, OrderEventRefund, nil, false},
+		{"partial refund partially refunded", &testStatusOrder{testOrder{status: OrderStatusPartiallyRefunded}}, OrderEventPartialRefund, nil, false},
+		{"refund pending", &testStatusOrder{testOrder{status: OrderStatusPending}}, OrderEventRefund, ErrOrderNotPaid, false},
+		{"refund closed", &testStatusOrder{testOrder{status: OrderStatusClosed}}, OrderEventRefund, ErrOrderNotPaid, false},
+		{"close paid", &testStatusOrder{testOrder{status: OrderStatusPaid}}, OrderEventClose, ErrOrderPaid, true},
+		{"close closed", &testStatusOrder{testOrder{status: OrderStatusClosed}}, OrderEventClose, ErrOrderClosed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckTransition(tt.order, tt.event)
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("got %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			var se *OrderStateError
+			if !errors.As(err, &se) || se.Event != tt.event {
+				t.Fatalf("got %#v", err)
+			}
+			if IsProcessed(err) != tt.processed {
+				t.Fatalf("IsProcessed(%v) = %v", err, !tt.processed)
+			}
+		})
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	tests := []struct {
+		order IOrder
+		want  OrderStatus
+	}{
+		{&testOrder{}, OrderStatusCreated},
+		{&testOrder{payed: true}, OrderStatusPaid},
+		{&testStatusOrder{testOrder{payed: true, status: OrderStatusRefunded}}, OrderStatusRefunded},
+	}
+
+	for _, tt := range tests {
+		if got := StatusOf(tt.order); got != tt.want {
+			t.Errorf("StatusOf(%+v) = %s, want %s", tt.order, got, tt.want)
+		}
+	}
+}
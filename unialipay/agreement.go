@@ -0,0 +1,291 @@
+package unialipay
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lovewith99/unipay"
+	alipayv3 "github.com/smartwalle/alipay/v3"
+)
+
+// 周期类型
+const (
+	PeriodTypeDay   = "DAY"
+	PeriodTypeMonth = "MONTH"
+)
+
+// 协议状态
+const (
+	AgreementStatusTemp   = "TEMP"   // 暂存, 协议未生效过
+	AgreementStatusNormal = "NORMAL" // 正常
+	AgreementStatusStop   = "STOP"   // 暂停
+	AgreementStatusUnsign = "UNSIGN" // 已解约
+)
+
+// Agreement 支付宝代扣协议
+type Agreement struct {
+	AgreementNo         string // 支付宝签约号
+	ExternalAgreementNo string // 商户签约号
+	ExternalLogonId     string // 用户在商户侧的登录账号
+	AlipayUserId        string // 用户的支付宝用户号
+	AlipayLogonId       string // 脱敏的支付宝账号
+	PersonalProductCode string // 协议产品码
+	SignScene           string // 签约场景
+	Status              string // 协议状态
+	SignTime            string // 签约时间
+	ValidTime           string // 生效时间
+	InvalidTime         string // 失效时间
+	UnsignTime          string // 解约时间
+}
+
+// AgreementService 代扣协议的处理接口
+// 签约/解约的结果通过该接口回调; 扣款订单则与普通订单一样, 走OrderService的Invoke/Revoke流程
+type AgreementService interface {
+	// Sign 用户签约成功
+	Sign(agreement *Agreement) error
+
+	// Unsign 用户解约, 执行与Sign相反的逻辑, 如关闭自动续费
+	Unsign(agreement *Agreement) error
+}
+
+// AgreementSign 签约参数
+type AgreementSign struct {
+	ExternalAgreementNo string    // 商户签约号, 需保证在商户系统中唯一
+	ExternalLogonId     string    // 用户在商户侧的登录账号, 展示在签约页面
+	PeriodType          string    // 周期类型, PeriodTypeDay | PeriodTypeMonth
+	Period              int       // 周期数, 与PeriodType组合为扣款周期
+	ExecuteTime         time.Time // 首次扣款日期
+	SingleAmount        int       // 单次扣款最大金额, 单位分
+}
+
+func (sign *AgreementSign) periodRuleParams() *alipayv3.PeriodRuleParams {
+	if sign.PeriodType == "" {
+		return nil
+	}
+
+	return &alipayv3.PeriodRuleParams{
+		PeriodType:   sign.PeriodType,
+		Period:       strconv.Itoa(sign.Period),
+		ExecuteTime:  sign.ExecuteTime.Format("2006-01-02"),
+		SingleAmount: unipay.NewMoney(int64(sign.SingleAmount), CNY).String(),
+	}
+}
+
+// agreementSignParams 支付并签约时的签约参数
+type agreementSignParams struct {
+	PersonalProductCode string                     `json:"personal_product_code"`
+	SignScene           string                     `json:"sign_scene"`
+	ExternalAgreementNo string                     `json:"external_agreement_no,omitempty"`
+	ExternalLogonId     string                     `json:"external_logon_id,omitempty"`
+	SignNotifyURL       string                     `json:"sign_notify_url,omitempty"`
+	AccessParams        *alipayv3.AccessParams     `json:"access_params"`
+	PeriodRuleParams    *alipayv3.PeriodRuleParams `json:"period_rule_params,omitempty"`
+}
+
+// tradeAppPayWithSign App支付并签约
+type tradeAppPayWithSign struct {
+	alipayv3.TradeAppPay
+	AgreementSignParams *agreementSignParams `json:"agreement_sign_params"`
+}
+
+// agreementUnsignRsp alipayv3.AgreementUnsignRsp 的响应节点名称有误, 无法解析出响应结果
+type agreementUnsignRsp struct {
+	Content struct {
+		Code    alipayv3.Code `json:"code"`
+		Msg     string        `json:"msg"`
+		SubCode string        `json:"sub_code"`
+		SubMsg  string        `json:"sub_msg"`
+	} `json:"alipay_user_agreement_unsign_response"`
+	Sign string `json:"sign"`
+}
+
+// AgreementPageSign 独立签约, 返回的sign_link在支付宝App内打开完成签约
+func (cli *Client) AgreementPageSign(sign *AgreementSign) (unipay.MapResult, error) {
+	obj := alipayv3.AgreementPageSign{}
+	obj.NotifyURL = cli.NotifyURL
+	obj.ReturnURL = cli.ReturnURL
+	obj.PersonalProductCode = cli.PersonalProductCode
+	obj.SignScene = cli.SignScene
+	obj.ExternalAgreementNo = sign.ExternalAgreementNo
+	obj.ExternalLogonId = sign.ExternalLogonId
+	obj.AccessParams = &alipayv3.AccessParams{Channel: "ALIPAYAPP"}
+	obj.PeriodRuleParams = sign.periodRuleParams()
+
+	signLink, err := cli.Client().AgreementPageSign(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"sign_link": signLink.String(),
+	}, nil
+}
+
+// AgreementPayment App支付并签约, 首期订单支付成功后同时完成代扣协议的签约
+func (cli *Client) AgreementPayment(ctx *unipay.Context, sign *AgreementSign) (unipay.MapResult, error) {
+	order, err := cli.postOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := tradeAppPayWithSign{}
+	obj.Trade, err = cli.trade(order.OrderInfo(), cli.DeductProductCode)
+	if err != nil {
+		return nil, err
+	}
+	obj.AgreementSignParams = &agreementSignParams{
+		PersonalProductCode: cli.PersonalProductCode,
+		SignScene:           cli.SignScene,
+		ExternalAgreementNo: sign.ExternalAgreementNo,
+		ExternalLogonId:     sign.ExternalLogonId,
+		SignNotifyURL:       cli.NotifyURL,
+		AccessParams:        &alipayv3.AccessParams{Channel: "ALIPAYAPP"},
+		PeriodRuleParams:    sign.periodRuleParams(),
+	}
+
+	values, err := cli.Client().URLValues(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"pay_info": values.Encode(),
+	}, nil
+}
+
+// AgreementQuery 查询代扣协议
+func (cli *Client) AgreementQuery(agreementNo string) (*Agreement, error) {
+	obj := alipayv3.AgreementQuery{}
+	obj.AgreementNo = agreementNo
+	obj.PersonalProductCode = cli.PersonalProductCode
+	obj.SignScene = cli.SignScene
+
+	resp, err := cli.Client().AgreementQuery(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Content.Code.IsSuccess() {
+		return nil, respError(resp.Content.Code, resp.Content.SubCode, resp.Content.SubMsg)
+	}
+
+	c := resp.Content
+	return &Agreement{
+		AgreementNo:         c.AgreementNo,
+		ExternalAgreementNo: c.ExternalAgreementNo,
+		ExternalLogonId:     c.ExternalLogonId,
+		AlipayUserId:        c.PrincipalId,
+		AlipayLogonId:       c.AlipayLogonId,
+		PersonalProductCode: c.PersonalProductCode,
+		SignScene:           c.SignScene,
+		Status:              c.Status,
+		SignTime:            c.SignTime,
+		ValidTime:           c.ValidTime,
+		InvalidTime:         c.InvalidTime,
+	}, nil
+}
+
+// AgreementUnsign 商户主动解约
+// 解约结果由支付宝通过dut_user_unsign通知异步回调, 在Notify中调用AgreementService.Unsign
+func (cli *Client) AgreementUnsign(agreementNo string) error {
+	obj := alipayv3.AgreementUnsign{}
+	obj.NotifyURL = cli.NotifyURL
+	obj.AgreementNo = agreementNo
+	obj.PersonalProductCode = cli.PersonalProductCode
+	obj.SignScene = cli.SignScene
+
+	var resp *agreementUnsignRsp
+	if err := cli.Client().DoRequest("POST", obj, &resp); err != nil {
+		return err
+	}
+
+	if !resp.Content.Code.IsSuccess() {
+		return respError(resp.Content.Code, resp.Content.SubCode, resp.Content.SubMsg)
+	}
+
+	return nil
+}
+
+// AgreementDeduct 根据代扣协议发起扣款
+// 扣款成功时直接执行OrderService.Invoke; 扣款处理中时由异步通知完成订单处理
+func (cli *Client) AgreementDeduct(ctx *unipay.Context, agreementNo string) (unipay.MapResult, error) {
+	order, err := cli.postOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := alipayv3.TradePay{}
+	obj.Trade, err = cli.trade(order.OrderInfo(), cli.DeductProductCode)
+	if err != nil {
+		return nil, err
+	}
+	obj.AgreementParams = &alipayv3.AgreementParams{
+		AgreementNo: agreementNo,
+	}
+
+	resp, err := cli.Client().TradePay(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	c := resp.Content
+	result := unipay.MapResult{
+		"out_trade_no": c.OutTradeNo,
+		"trade_no":     c.TradeNo,
+	}
+
+	switch c.Code {
+	case alipayv3.CodeSuccess:
+		result["status"] = "paid"
+		return result, cli.Invoke(c.OutTradeNo)
+	case "10003":
+		// 等待用户付款, 结果以异步通知为准
+		result["status"] = "pending"
+		return result, nil
+	}
+
+	return nil, respError(c.Code, c.SubCode, c.SubMsg)
+}
+
+// Invoke 处理已支付的订单
+func (cli *Client) Invoke(outTradeNo string) error {
+	unlock, err := unipay.AcquireLock(cli.Locker, outTradeNo, cli.LockOptions)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	svc := cli.OrderService
+	order, err := svc.GetOrderByTradeNo(outTradeNo, unipay.PayWay_AliPay)
+	if err != nil {
+		return err
+	}
+
+	if err := unipay.CheckTransition(order, unipay.OrderEventPay); err != nil {
+		// 订单已处理，直接返回
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	return svc.Invoke(order)
+}
+
+func agreementFromValues(values url.Values) *Agreement {
+	return &Agreement{
+		AgreementNo:         values.Get("agreement_no"),
+		ExternalAgreementNo: values.Get("external_agreement_no"),
+		ExternalLogonId:     values.Get("external_logon_id"),
+		AlipayUserId:        values.Get("alipay_user_id"),
+		AlipayLogonId:       values.Get("alipay_logon_id"),
+		PersonalProductCode: values.Get("personal_product_code"),
+		SignScene:           values.Get("sign_scene"),
+		Status:              values.Get("status"),
+		SignTime:            values.Get("sign_time"),
+		ValidTime:           values.Get("valid_time"),
+		InvalidTime:         values.Get("invalid_time"),
+		UnsignTime:          values.Get("unsign_time"),
+	}
+}
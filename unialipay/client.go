@@ -1,7 +1,14 @@
 package unialipay
 
 import (
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lovewith99/unipay"
 	alipayv3 "github.com/smartwalle/alipay/v3"
@@ -10,34 +17,43 @@ import (
 type Client struct {
 	Config
 
-	client       *alipayv3.Client
-	OrderService unipay.OrderService
+	mu                sync.RWMutex
+	client            *alipayv3.Client
+	Locker            unipay.Locker
+	LockOptions       unipay.LockOptions
+	OrderService      unipay.OrderService
+	AgreementService  AgreementService
+	NotificationStore unipay.NotificationStore
+	RequestSigner     *unipay.RequestSigner
 }
 
 func (cli *Client) Client() *alipayv3.Client {
+	cli.mu.RLock()
+	defer cli.mu.RUnlock()
 	return cli.client
 }
 
-func (cli *Client) Payment(ctx *unipay.Context) (unipay.MapResult, error) {
-	svc := cli.OrderService
+// postOrder 校验客户端请求签名后创建订单, 所有创建订单的支付方式都需要经过这里
+func (cli *Client) postOrder(ctx *unipay.Context) (unipay.IOrder, error) {
+	if err := cli.RequestSigner.Verify(&ctx.Request); err != nil {
+		return nil, err
+	}
+	return cli.OrderService.PostOrder(ctx)
+}
 
-	// order, err := svc.PostOrder(ctx)
-	order, err := svc.PostOrder(ctx)
+func (cli *Client) Payment(ctx *unipay.Context) (unipay.MapResult, error) {
+	order, err := cli.postOrder(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	obj := alipayv3.TradeAppPay{}
-	obj.ProductCode = "QUICK_MSECURITY_PAY"
-	obj.NotifyURL = cli.NotifyURL
-
-	info := order.OrderInfo()
-	obj.Subject = info.Subject
-	obj.OutTradeNo = info.OutTradeNo
-	obj.TotalAmount = fmt.Sprintf("%.2f", float64(info.TotalFee)/100)
-	obj.PassbackParams = info.Attach
+	obj.Trade, err = cli.trade(order.OrderInfo(), "QUICK_MSECURITY_PAY")
+	if err != nil {
+		return nil, err
+	}
 
-	sign, err := cli.client.TradeAppPay(obj)
+	sign, err := cli.Client().TradeAppPay(obj)
 	if err != nil {
 		return nil, err
 	}
@@ -47,25 +63,19 @@ func (cli *Client) Payment(ctx *unipay.Context) (unipay.MapResult, error) {
 }
 
 func (cli *Client) WapPayment(ctx *unipay.Context) (unipay.MapResult, error) {
-	svc := cli.OrderService
-
-	order, err := svc.PostOrder(ctx)
+	order, err := cli.postOrder(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	obj := alipayv3.TradeWapPay{}
-	obj.ProductCode = "QUICK_WAP_WAY"
+	obj.Trade, err = cli.trade(order.OrderInfo(), "QUICK_WAP_WAY")
+	if err != nil {
+		return nil, err
+	}
 	obj.ReturnURL = cli.ReturnURL
-	obj.NotifyURL = cli.NotifyURL
-
-	info := order.OrderInfo()
-	obj.Subject = info.Subject
-	obj.OutTradeNo = info.OutTradeNo
-	obj.TotalAmount = fmt.Sprintf("%.2f", float64(info.TotalFee)/100)
-	obj.PassbackParams = info.Attach
 
-	payLink, err := cli.client.TradeWapPay(obj)
+	payLink, err := cli.Client().TradeWapPay(obj)
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +86,112 @@ func (cli *Client) WapPayment(ctx *unipay.Context) (unipay.MapResult, error) {
 	}, nil
 }
 
+// PagePayment 电脑网站支付
+func (cli *Client) PagePayment(ctx *unipay.Context) (unipay.MapResult, error) {
+	order, err := cli.postOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := alipayv3.TradePagePay{}
+	obj.Trade, err = cli.trade(order.OrderInfo(), "FAST_INSTANT_TRADE_PAY")
+	if err != nil {
+		return nil, err
+	}
+	obj.ReturnURL = cli.ReturnURL
+
+	payLink, err := cli.Client().TradePagePay(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"pay_link": payLink.String(),
+	}, nil
+}
+
+// PrecreatePayment 当面付扫码支付, 返回的qr_code由调用方生成二维码展示给用户
+func (cli *Client) PrecreatePayment(ctx *unipay.Context) (unipay.MapResult, error) {
+	order, err := cli.postOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := alipayv3.TradePreCreate{}
+	obj.Trade, err = cli.trade(order.OrderInfo(), "FACE_TO_FACE_PAYMENT")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cli.Client().TradePreCreate(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.IsSuccess() {
+		return nil, respError(resp.Content.Code, resp.Content.SubCode, resp.Content.SubMsg)
+	}
+
+	return map[string]interface{}{
+		"out_trade_no": resp.Content.OutTradeNo,
+		"qr_code":      resp.Content.QRCode,
+	}, nil
+}
+
+// trade 根据订单信息构造公共的交易参数
+func (cli *Client) trade(info *unipay.OrderInfo, productCode string) (alipayv3.Trade, error) {
+	obj := alipayv3.Trade{}
+	amount, err := totalAmount(info)
+	if err != nil {
+		return obj, err
+	}
+
+	obj.ProductCode = productCode
+	obj.NotifyURL = cli.NotifyURL
+
+	obj.Subject = info.Subject
+	obj.OutTradeNo = info.OutTradeNo
+	obj.TotalAmount = amount.String()
+	obj.PassbackParams = info.Attach
+	obj.TimeoutExpress = TimeoutExpress(info.Timeout)
+	return obj, nil
+}
+
+// totalAmount 订单金额, total_amount只支持人民币, 币种为空时为CNY, 其他币种返回错误
+func totalAmount(info *unipay.OrderInfo) (unipay.Money, error) {
+	amount := info.Money()
+	if amount.Currency == "" {
+		amount.Currency = CNY
+	}
+	if amount.Currency != CNY {
+		return amount, fmt.Errorf("unialipay: unsupported currency %s", amount.Currency)
+	}
+	return amount, nil
+}
+
+// checkAmount 校验支付宝返回的金额与订单金额一致
+func checkAmount(info *unipay.OrderInfo, value string) bool {
+	total, err := totalAmount(info)
+	if err != nil {
+		return false
+	}
+	amount, err := unipay.ParseMoney(value, total.Currency)
+	return err == nil && amount.Equal(total)
+}
+
+// TimeoutExpress 将订单超时时间转换为timeout_express参数, 取值范围1m~15d
+func TimeoutExpress(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+
+	minutes := int64((d + time.Minute - 1) / time.Minute)
+	if max := int64(15 * 24 * 60); minutes > max {
+		minutes = max
+	}
+	return strconv.FormatInt(minutes, 10) + "m"
+}
+
 type ClientOption func(*Client)
 
 func NewClient(prod bool, appId, partnerId string, opts ...ClientOption) (*Client, error) {
@@ -89,20 +205,135 @@ func NewClient(prod bool, appId, partnerId string, opts ...ClientOption) (*Clien
 		opt(cli)
 	}
 
-	cli.client, err = alipayv3.New(cli.appId, cli.privateKey, cli.IsProd)
+	if cli.Locker == nil {
+		cli.Locker = unipay.LockerImpl{}
+	}
+
+	if cli.PersonalProductCode == "" {
+		cli.PersonalProductCode = DefaultPersonalProductCode
+	}
+
+	if cli.SignScene == "" {
+		cli.SignScene = DefaultSignScene
+	}
+
+	if cli.DeductProductCode == "" {
+		cli.DeductProductCode = DefaultDeductProductCode
+	}
+
+	switch cli.Mode {
+	case "":
+		cli.Mode = KeyMode
+	case KeyMode, CertMode:
+	default:
+		return nil, fmt.Errorf("unialipay: invalid mode %q", cli.Mode)
+	}
+
+	cli.client, err = cli.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return cli, nil
+}
+
+func (cli *Client) newClient() (*alipayv3.Client, error) {
+	client, err := alipayv3.New(cli.appId, cli.privateKey, cli.IsProd)
 	if err != nil {
 		return nil, err
 	}
 
 	if cli.Mode == CertMode {
-		cli.client.LoadAppPublicCertFromFile(cli.appCertSnFile)
-		cli.client.LoadAliPayRootCertFromFile(cli.rootCertSnFile)
-		cli.client.LoadAliPayPublicCertFromFile(cli.aliPublicCertSnFile)
+		err = cli.loadCerts(client)
 	} else {
-		err = cli.client.LoadAliPayPublicKey(cli.aliPublicKey)
+		err = client.LoadAliPayPublicKey(cli.aliPublicKey)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// loadCerts 加载公钥证书, 证书内容优先于证书文件
+func (cli *Client) loadCerts(client *alipayv3.Client) error {
+	appCert, err := readCert(cli.appCert, cli.appCertSnFile)
+	if err != nil {
+		return fmt.Errorf("unialipay: app public cert: %w", err)
+	}
+
+	rootCert, err := readCert(cli.rootCert, cli.rootCertSnFile)
+	if err != nil {
+		return fmt.Errorf("unialipay: alipay root cert: %w", err)
+	}
+
+	aliPublicCert, err := readCert(cli.aliPublicCert, cli.aliPublicCertSnFile)
+	if err != nil {
+		return fmt.Errorf("unialipay: alipay public cert: %w", err)
+	}
+
+	if err := client.LoadAppPublicCert(string(appCert)); err != nil {
+		return fmt.Errorf("unialipay: app public cert: %w", err)
+	}
+
+	// LoadAliPayRootCert 会忽略无法解析的证书, 这里需要先校验
+	if block, _ := pem.Decode(rootCert); block == nil {
+		return errors.New("unialipay: alipay root cert: no PEM data found")
+	}
+	if err := client.LoadAliPayRootCert(string(rootCert)); err != nil {
+		return fmt.Errorf("unialipay: alipay root cert: %w", err)
+	}
+
+	if err := client.LoadAliPayPublicCert(string(aliPublicCert)); err != nil {
+		return fmt.Errorf("unialipay: alipay public cert: %w", err)
+	}
+
+	return nil
+}
+
+func readCert(cert []byte, filename string) ([]byte, error) {
+	if len(cert) > 0 {
+		return cert, nil
+	}
+
+	if filename == "" {
+		return nil, errors.New("unialipay: cert not configured")
+	}
+
+	return ioutil.ReadFile(filename)
+}
+
+// ReloadCerts 重新加载公钥证书, 用于不重建Client的情况下轮换证书
+// 参数为nil时沿用原有的证书配置, 如从CertFiles指定的文件重新读取
+// 新证书加载失败时返回错误, 原有证书继续生效
+func (cli *Client) ReloadCerts(appCert, rootCert, aliPublicCert []byte) error {
+	if cli.Mode != CertMode {
+		return errors.New("unialipay: reload certs requires CertMode")
+	}
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	cfg := cli.Config
+	if appCert != nil {
+		cli.appCert = appCert
+	}
+	if rootCert != nil {
+		cli.rootCert = rootCert
+	}
+	if aliPublicCert != nil {
+		cli.aliPublicCert = aliPublicCert
 	}
 
-	return cli, err
+	client, err := cli.newClient()
+	if err != nil {
+		cli.Config = cfg
+		return err
+	}
+
+	cli.client = client
+	return nil
 }
 
 func Mode(mode string) ClientOption {
@@ -137,6 +368,15 @@ func CertFiles(appCertSn, rootCertSn, aliPublicCertSn string) ClientOption {
 	}
 }
 
+// Certs 公钥证书模式下直接使用证书内容(PEM), 适用于证书不落盘的场景
+func Certs(appCert, rootCert, aliPublicCert []byte) ClientOption {
+	return func(cli *Client) {
+		cli.appCert = appCert
+		cli.rootCert = rootCert
+		cli.aliPublicCert = aliPublicCert
+	}
+}
+
 func NotifyURL(notifyUrl, returnUrl string) ClientOption {
 	return func(cli *Client) {
 		cli.NotifyURL = notifyUrl
@@ -144,8 +384,71 @@ func NotifyURL(notifyUrl, returnUrl string) ClientOption {
 	}
 }
 
+// ReturnQuery 同步跳转时订单尚未收到异步通知, 主动查询交易状态
+func ReturnQuery(enable bool) ClientOption {
+	return func(cli *Client) {
+		cli.ReturnQuery = enable
+	}
+}
+
 func WithOrderService(svc unipay.OrderService) ClientOption {
 	return func(cli *Client) {
 		cli.OrderService = svc
 	}
 }
+
+func WithLocker(locker unipay.Locker) ClientOption {
+	return func(cli *Client) {
+		cli.Locker = locker
+	}
+}
+
+// WithLockOptions 按out_trade_no加锁的过期时间和等待时间, 默认未获得锁时立即返回unipay.ErrConcurrentProcessing
+func WithLockOptions(opts unipay.LockOptions) ClientOption {
+	return func(cli *Client) {
+		cli.LockOptions = opts
+	}
+}
+
+// WithRequestSigner App/手机网站/电脑网站/扫码支付和代扣创建订单前校验客户端请求的签名和时间戳
+func WithRequestSigner(signer *unipay.RequestSigner) ClientOption {
+	return func(cli *Client) {
+		cli.RequestSigner = signer
+	}
+}
+
+func WithAgreementService(svc AgreementService) ClientOption {
+	return func(cli *Client) {
+		cli.AgreementService = svc
+	}
+}
+
+// WithNotificationStore 异步通知去重, 以notify_id作为通知ID
+func WithNotificationStore(store unipay.NotificationStore) ClientOption {
+	return func(cli *Client) {
+		cli.NotificationStore = store
+	}
+}
+
+// AgreementProduct 设置周期扣款的签约产品码, 签约场景和扣款产品码, 与支付宝签约时确定
+func AgreementProduct(personalProductCode, signScene, deductProductCode string) ClientOption {
+	return func(cli *Client) {
+		cli.PersonalProductCode = personalProductCode
+		cli.SignScene = signScene
+		cli.DeductProductCode = deductProductCode
+	}
+}
+
+// respError 支付宝业务错误, 服务不可用和系统错误为可重试的错误
+func respError(code alipayv3.Code, subCode, subMsg string) error {
+	err := &unipay.ProviderError{
+		PayWay:    unipay.PayWay_AliPay,
+		Code:      subCode,
+		Message:   subMsg,
+		Retryable: code == alipayv3.CodeUnknowError || strings.HasSuffix(subCode, "SYSTEM_ERROR"),
+	}
+	if err.Code == "" {
+		err.Code = string(code)
+	}
+	return err
+}
@@ -5,6 +5,16 @@ const (
 	CertMode = "CertMode" // 公钥证书模式
 )
 
+// CNY 支付宝交易的结算币种, 订单币种为空时按人民币分处理, 不支持其他币种
+const CNY = "CNY"
+
+// 周期扣款默认参数
+const (
+	DefaultPersonalProductCode = "CYCLE_PAY_AUTH_P"
+	DefaultSignScene           = "INDUSTRY|DIGITAL_MEDIA"
+	DefaultDeductProductCode   = "CYCLE_PAY_AUTH"
+)
+
 type Config struct {
 	IsProd bool
 	Mode   string
@@ -22,6 +32,19 @@ type Config struct {
 	rootCertSnFile      string // 支付宝根证书
 	aliPublicCertSnFile string // 支付宝公钥匙证书
 
+	// 公钥证书模式, 证书内容, 优先于证书文件
+	appCert       []byte
+	rootCert      []byte
+	aliPublicCert []byte
+
 	NotifyURL string
 	ReturnURL string
+
+	// ReturnQuery 同步跳转时订单未支付, 是否主动查询交易状态
+	ReturnQuery bool
+
+	// 周期扣款(代扣)
+	PersonalProductCode string // 个人签约产品码
+	SignScene           string // 签约场景
+	DeductProductCode   string // 扣款销售产品码
 }
@@ -0,0 +1,97 @@
+package unialipay
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/lovewith99/unipay"
+	alipayv3 "github.com/smartwalle/alipay/v3"
+)
+
+// 通知类型
+const (
+	NotifyTypeUserSign   = "dut_user_sign"   // 代扣协议签约
+	NotifyTypeUserUnsign = "dut_user_unsign" // 代扣协议解约
+)
+
+// VerifySign 验证支付宝回传参数的签名
+func (cli *Client) VerifySign(values url.Values) error {
+	ok, err := cli.Client().VerifySign(values)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: alipay", unipay.ErrSignatureInvalid)
+	}
+
+	return nil
+}
+
+// Notify 处理支付宝异步通知, 包括交易状态通知和代扣协议签约/解约通知
+// 返回nil时调用方需要应答"success"(alipayv3.AckNotification), 否则支付宝会重复通知
+func (cli *Client) Notify(req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+
+	if err := cli.VerifySign(req.Form); err != nil {
+		return err
+	}
+
+	return unipay.ProcessNotification(cli.NotificationStore, &unipay.Notification{
+		PayWay:  unipay.PayWay_AliPay,
+		ID:      req.Form.Get("notify_id"),
+		Type:    req.Form.Get("notify_type"),
+		Header:  req.Header,
+		Payload: []byte(req.Form.Encode()),
+	}, func() error {
+		return cli.notify(req.Form)
+	})
+}
+
+func (cli *Client) notify(values url.Values) error {
+	switch values.Get("notify_type") {
+	case NotifyTypeUserSign:
+		if cli.AgreementService == nil {
+			return nil
+		}
+		return cli.AgreementService.Sign(agreementFromValues(values))
+	case NotifyTypeUserUnsign:
+		if cli.AgreementService == nil {
+			return nil
+		}
+		return cli.AgreementService.Unsign(agreementFromValues(values))
+	case alipayv3.NotifyTypeTradeStatusSync:
+		return cli.tradeNotify(values)
+	}
+
+	return nil
+}
+
+func (cli *Client) tradeNotify(values url.Values) error {
+	if values.Get("app_id") != cli.appId {
+		return fmt.Errorf("%w: app id", unipay.ErrBundleMismatch)
+	}
+
+	switch alipayv3.TradeStatus(values.Get("trade_status")) {
+	case alipayv3.TradeStatusSuccess, alipayv3.TradeStatusFinished:
+	default:
+		// 交易创建/关闭的通知不需要处理
+		return nil
+	}
+
+	outTradeNo := values.Get("out_trade_no")
+	order, err := cli.OrderService.GetOrderByTradeNo(outTradeNo, unipay.PayWay_AliPay)
+	if err != nil {
+		return err
+	}
+
+	info := order.OrderInfo()
+	if !checkAmount(info, values.Get("total_amount")) {
+		return fmt.Errorf("%w: %s", unipay.ErrAmountMismatch, outTradeNo)
+	}
+
+	return cli.Invoke(outTradeNo)
+}
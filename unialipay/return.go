@@ -0,0 +1,95 @@
+package unialipay
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/lovewith99/unipay"
+	alipayv3 "github.com/smartwalle/alipay/v3"
+)
+
+// 同步跳转时的订单状态
+const (
+	ReturnStatusPaid    = "paid"    // 订单已支付
+	ReturnStatusPending = "pending" // 尚未收到异步通知, 支付结果未知
+	ReturnStatusFailed  = "failed"  // 支付失败或交易已关闭
+)
+
+// VerifyReturn 验证支付完成后跳转到ReturnURL时携带的参数, 返回订单状态用于页面展示
+// 跳转时异步通知可能尚未到达, 开启ReturnQuery后会主动查询交易状态, 并处理已支付的订单
+func (cli *Client) VerifyReturn(values url.Values) (unipay.MapResult, error) {
+	if err := cli.VerifySign(values); err != nil {
+		return nil, err
+	}
+
+	if values.Get("app_id") != cli.appId {
+		return nil, fmt.Errorf("%w: app id", unipay.ErrBundleMismatch)
+	}
+
+	outTradeNo := values.Get("out_trade_no")
+	order, err := cli.OrderService.GetOrderByTradeNo(outTradeNo, unipay.PayWay_AliPay)
+	if err != nil {
+		return nil, err
+	}
+
+	result := unipay.MapResult{
+		"out_trade_no": outTradeNo,
+		"trade_no":     values.Get("trade_no"),
+		"status":       ReturnStatusPending,
+	}
+
+	info := order.OrderInfo()
+	if !checkAmount(info, values.Get("total_amount")) {
+		result["status"] = ReturnStatusFailed
+		return result, nil
+	}
+
+	if err := unipay.CheckTransition(order, unipay.OrderEventPay); err != nil {
+		// 订单已处理，直接返回
+		if unipay.IsProcessed(err) {
+			result["status"] = ReturnStatusPaid
+			return result, nil
+		}
+		if errors.Is(err, unipay.ErrOrderClosed) {
+			result["status"] = ReturnStatusFailed
+			return result, nil
+		}
+		return nil, err
+	}
+
+	if cli.ReturnQuery {
+		result["status"] = cli.queryStatus(order)
+	}
+
+	return result, nil
+}
+
+// queryStatus 主动查询交易状态, 交易成功时执行Invoke
+func (cli *Client) queryStatus(order unipay.IOrder) string {
+	info := order.OrderInfo()
+
+	obj := alipayv3.TradeQuery{}
+	obj.OutTradeNo = info.OutTradeNo
+
+	resp, err := cli.Client().TradeQuery(obj)
+	if err != nil || !resp.IsSuccess() {
+		return ReturnStatusPending
+	}
+
+	switch resp.Content.TradeStatus {
+	case alipayv3.TradeStatusSuccess, alipayv3.TradeStatusFinished:
+		if !checkAmount(info, resp.Content.TotalAmount) {
+			return ReturnStatusFailed
+		}
+
+		if err := cli.Invoke(info.OutTradeNo); err != nil {
+			return ReturnStatusPending
+		}
+		return ReturnStatusPaid
+	case alipayv3.TradeStatusClosed:
+		return ReturnStatusFailed
+	}
+
+	return ReturnStatusPending
+}
@@ -2,7 +2,7 @@ package uniapple
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -52,6 +52,20 @@ func WithLocker(locker unipay.Locker) ClientOption {
 	}
 }
 
+// WithLockOptions 按transaction_id加锁的过期时间和等待时间, 默认不等待
+func WithLockOptions(opts unipay.LockOptions) ClientOption {
+	return func(cli *Client) {
+		cli.LockOptions = opts
+	}
+}
+
+// WithRequestSigner 向苹果校验收据前先校验客户端请求签名, 收据receipt-data参与签名
+func WithRequestSigner(signer *unipay.RequestSigner) ClientOption {
+	return func(cli *Client) {
+		cli.RequestSigner = signer
+	}
+}
+
 func WithAttachService(svc unipay.AttachService) ClientOption {
 	return func(cli *Client) {
 		cli.AttachService = svc
@@ -64,13 +78,23 @@ func WithOrderService(svc unipay.IapOrderService) ClientOption {
 	}
 }
 
+// WithNotificationStore App Store服务器通知去重, 以notificationUUID作为通知ID
+func WithNotificationStore(store unipay.NotificationStore) ClientOption {
+	return func(cli *Client) {
+		cli.NotificationStore = store
+	}
+}
+
 type Client struct {
 	Config
 	client *appstore.Client
 
-	Locker        unipay.Locker
-	OrderService  unipay.IapOrderService
-	AttachService unipay.AttachService
+	Locker            unipay.Locker
+	LockOptions       unipay.LockOptions
+	OrderService      unipay.IapOrderService
+	AttachService     unipay.AttachService
+	NotificationStore unipay.NotificationStore
+	RequestSigner     *unipay.RequestSigner
 }
 
 func (cli *Client) Client() *appstore.Client {
@@ -93,8 +117,16 @@ func (cli *Client) VerifyReciept(req *appstore.IAPRequest, retry uint) (*appstor
 		return resp, err
 	}
 
-	err = appstore.HandleError(resp.Status)
-	return resp, err
+	if err = appstore.HandleError(resp.Status); err != nil {
+		return resp, &unipay.ProviderError{
+			PayWay:  unipay.PayWay_AppStore,
+			Code:    strconv.Itoa(resp.Status),
+			Message: err.Error(),
+			// 21005: 服务器不可用, 21009/21100-21199: 苹果内部错误
+			Retryable: resp.Status == 21005 || resp.Status == 21009 || (resp.Status >= 21100 && resp.Status <= 21199),
+		}
+	}
+	return resp, nil
 }
 
 func (cli *Client) GetInapp(resp *appstore.IAPResponse, transactionId string) *appstore.InApp {
@@ -158,6 +190,10 @@ func (cli *Client) UnLockInapp(transactionId string) error {
 }
 
 func (cli *Client) Payment(ctx *unipay.Context) error {
+	if err := cli.RequestSigner.Verify(&ctx.Request); err != nil {
+		return err
+	}
+
 	cli.CreateInappAttach(ctx.TransactionId, ctx.Attach)
 
 	ctx.IAPRequest.Password = cli.password
@@ -167,7 +203,7 @@ func (cli *Client) Payment(ctx *unipay.Context) error {
 	}
 
 	if resp.Receipt.BundleID != cli.bundleID {
-		return errors.New("bundle id mismath")
+		return fmt.Errorf("%w: bundle id %s", unipay.ErrBundleMismatch, resp.Receipt.BundleID)
 	}
 
 	inapp := cli.GetInapp(resp, ctx.TransactionId)
@@ -184,11 +220,11 @@ func (cli *Client) Invoke(ctx *unipay.Context, inapp *appstore.InApp) error {
 	}
 	ctx.ProductID = inapp.ProductID
 
-	if ok, _ := cli.LockInapp(inapp.TransactionID); !ok {
-		// 并发处理同一笔订单, 未获得锁
-		return errors.New("concurrency deal: " + inapp.TransactionID)
+	unlock, err := unipay.AcquireLock(cli.Locker, inapp.TransactionID, cli.LockOptions)
+	if err != nil {
+		return err
 	}
-	defer cli.UnLockInapp(inapp.TransactionID)
+	defer unlock()
 
 	svc := cli.OrderService
 	order, err := svc.GetOrderByTradeNo(inapp.TransactionID, unipay.PayWay_AppStore)
@@ -207,9 +243,12 @@ func (cli *Client) Invoke(ctx *unipay.Context, inapp *appstore.InApp) error {
 	// 	return err
 	// }
 
-	// 订单已处理，直接返回
-	if order.Payed() {
-		return nil
+	if err := unipay.CheckTransition(order, unipay.OrderEventPay); err != nil {
+		// 订单已处理，直接返回
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
 	}
 
 	return svc.Invoke(order)
@@ -221,19 +260,27 @@ func (cli *Client) Revoke(ctx *unipay.Context, inapp *appstore.InApp) error {
 		return unipay.OrderNotFoundError
 	}
 	ctx.ProductID = inapp.ProductID
-	if ok, _ := cli.LockInapp(inapp.TransactionID); !ok {
-		// 并发处理同一笔订单, 未获得锁
-		return errors.New("concurrency deal: " + inapp.TransactionID)
+	unlock, err := unipay.AcquireLock(cli.Locker, inapp.TransactionID, cli.LockOptions)
+	if err != nil {
+		return err
 	}
-	defer cli.UnLockInapp(inapp.TransactionID)
+	defer unlock()
 
 	svc := cli.OrderService
 	order, err := svc.GetOrderByTradeNo(inapp.TransactionID, unipay.PayWay_AppStore)
-	if err == nil {
-		err = svc.Revoke(order)
+	if err != nil {
+		return err
 	}
 
-	return err
+	if err := unipay.CheckTransition(order, unipay.OrderEventRefund); err != nil {
+		// 订单已退款，直接返回; 未支付的订单不能退款
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	return svc.Revoke(order)
 }
 
 func (cli *Client) CheckSubUser(ctx *unipay.Context, inapp *appstore.InApp) error {
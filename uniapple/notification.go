@@ -1,5 +1,7 @@
 package uniapple
 
+import "github.com/lovewith99/unipay"
+
 // appstore server notify v2
 type AppstoreServerNotifyV2 struct {
 	SignedPayload string `json:"signedPayload"`
@@ -35,3 +37,14 @@ type JWSDecodedHeader struct {
 	Kid string `json:"kid"`
 	X5c string `json:"x5c"`
 }
+
+// Notification 处理App Store服务器通知, payload为解码后的通知, body为原始请求报文
+// 配置了NotificationStore时以notificationUUID去重, 已处理成功的通知不再执行handle
+func (cli *Client) Notification(payload *AppstoreDecodedPayload, body []byte, handle func() error) error {
+	return unipay.ProcessNotification(cli.NotificationStore, &unipay.Notification{
+		PayWay:  unipay.PayWay_AppStore,
+		ID:      payload.NotificationUUID,
+		Type:    payload.NotificationType,
+		Payload: body,
+	}, handle)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/awa/go-iap/playstore"
@@ -18,9 +19,13 @@ type Client struct {
 	Config
 
 	Locker          unipay.Locker
+	LockOptions     unipay.LockOptions
 	OrderService    unipay.IapOrderService
 	AttachService   unipay.AttachService
 	PubliserService PublisherService
+
+	NotificationStore unipay.NotificationStore
+	RequestSigner     *unipay.RequestSigner
 }
 
 func NewClient(opts ...ClientOption) (*Client, error) {
@@ -65,6 +70,22 @@ func WithLocker(locker unipay.Locker) ClientOption {
 	}
 }
 
+// WithLockOptions 按google订单号加锁的过期时间和等待时间, 默认不等待
+func WithLockOptions(opts unipay.LockOptions) ClientOption {
+	return func(cli *Client) (err error) {
+		cli.LockOptions = opts
+		return
+	}
+}
+
+// WithRequestSigner 校验purchase_data签名前先校验客户端请求签名
+func WithRequestSigner(signer *unipay.RequestSigner) ClientOption {
+	return func(cli *Client) (err error) {
+		cli.RequestSigner = signer
+		return
+	}
+}
+
 func WithAttachService(svc unipay.AttachService) ClientOption {
 	return func(cli *Client) (err error) {
 		cli.AttachService = svc
@@ -79,10 +100,18 @@ func WithOrderService(svc unipay.IapOrderService) ClientOption {
 	}
 }
 
+// WithNotificationStore 实时开发者通知去重, 以Pub/Sub messageId作为通知ID
+func WithNotificationStore(store unipay.NotificationStore) ClientOption {
+	return func(cli *Client) (err error) {
+		cli.NotificationStore = store
+		return
+	}
+}
+
 func WithPublisherService(svc PublisherService) ClientOption {
 	return func(cli *Client) (err error) {
 		if svc == nil {
-			err = errors.New("PublisherService is nil")
+			err = errors.New("unigoogle: PublisherService is nil")
 		} else {
 			cli.PubliserService = svc
 		}
@@ -97,13 +126,18 @@ func (cli *Client) VerifyPurchaseDataSign(purchaseData []byte, sign string) erro
 	}
 
 	if !ok {
-		return errors.New("invalid purchase data sign")
+		return fmt.Errorf("%w: purchase data", unipay.ErrSignatureInvalid)
 	}
 
 	return nil
 }
 
 func (cli *Client) Payment(ctx *unipay.Context) error {
+	// step0: 验证客户端请求签名
+	if err := cli.RequestSigner.Verify(&ctx.Request); err != nil {
+		return err
+	}
+
 	// step1: 验证签名
 	purchaseData := []byte(ctx.PurchaseData)
 	err := cli.VerifyPurchaseDataSign(purchaseData, ctx.PurchaseDataSign)
@@ -119,7 +153,7 @@ func (cli *Client) Payment(ctx *unipay.Context) error {
 	}
 
 	if inapp.PackageName != cli.PackageName {
-		return errors.New("package name mismatch")
+		return fmt.Errorf("%w: package name %s", unipay.ErrBundleMismatch, inapp.PackageName)
 	}
 
 	return cli.Invoke(ctx, &inapp)
@@ -170,18 +204,27 @@ func (cli *Client) Revoke(ctx *unipay.Context, inapp *iap.PurchaseData) error {
 	ctx.ProductID = inapp.ProductId
 	cli.SetOriOrderId(inapp)
 
-	if ok, _ := cli.LockOrder(inapp.OrderId); !ok {
-		return errors.New("concurrency deal: " + inapp.OrderId)
+	unlock, err := unipay.AcquireLock(cli.Locker, inapp.OrderId, cli.LockOptions)
+	if err != nil {
+		return err
 	}
-	defer cli.UnLockOrder(inapp.OrderId)
+	defer unlock()
 
 	svc := cli.OrderService
 	order, err := svc.GetOrderByTradeNo(inapp.OrderId, unipay.PayWay_PlayStore)
-	if err == nil {
-		err = svc.Revoke(order)
+	if err != nil {
+		return err
 	}
 
-	return err
+	if err := unipay.CheckTransition(order, unipay.OrderEventRefund); err != nil {
+		// 订单已退款，直接返回; 未支付的订单不能退款
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	return svc.Revoke(order)
 }
 
 func (cli *Client) Invoke(ctx *unipay.Context, inapp *iap.PurchaseData) error {
@@ -192,10 +235,11 @@ func (cli *Client) Invoke(ctx *unipay.Context, inapp *iap.PurchaseData) error {
 	ctx.ProductID = inapp.ProductId
 	cli.SetOriOrderId(inapp)
 
-	if ok, _ := cli.LockOrder(inapp.OrderId); !ok {
-		return errors.New("concurrency deal: " + inapp.OrderId)
+	unlock, err := unipay.AcquireLock(cli.Locker, inapp.OrderId, cli.LockOptions)
+	if err != nil {
+		return err
 	}
-	defer cli.UnLockOrder(inapp.OrderId)
+	defer unlock()
 
 	svc := cli.OrderService
 	order, err := svc.GetOrderByTradeNo(inapp.OrderId, unipay.PayWay_PlayStore)
@@ -213,9 +257,12 @@ func (cli *Client) Invoke(ctx *unipay.Context, inapp *iap.PurchaseData) error {
 	// if err != nil {
 	// 	return err
 	// }
-	// 订单已处理，直接返回
-	if order.Payed() {
-		return nil
+	if err := unipay.CheckTransition(order, unipay.OrderEventPay); err != nil {
+		// 订单已处理，直接返回
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
 	}
 
 	return svc.Invoke(order)
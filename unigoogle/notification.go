@@ -3,9 +3,11 @@ package unigoogle
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/awa/go-iap/playstore"
+	"github.com/lovewith99/unipay"
 )
 
 // google订阅的通知类型
@@ -110,6 +112,28 @@ func (noti *RTDNotification) GetDeveloperNotification() (*DeveloperNotification,
 	return &obj, nil
 }
 
+// Notification 处理实时开发者通知, body为Pub/Sub推送的原始请求报文
+// 配置了NotificationStore时以messageId去重, 已处理成功的通知不再执行handle
+func (cli *Client) Notification(noti *RTDNotification, body []byte, handle func(*DeveloperNotification) error) error {
+	dn, err := noti.GetDeveloperNotification()
+	if err != nil {
+		return err
+	}
+
+	if dn.PackageName != cli.PackageName {
+		return fmt.Errorf("%w: package name %s", unipay.ErrBundleMismatch, dn.PackageName)
+	}
+
+	return unipay.ProcessNotification(cli.NotificationStore, &unipay.Notification{
+		PayWay:  unipay.PayWay_PlayStore,
+		ID:      noti.Message.MessageID,
+		Type:    dn.notificationType(),
+		Payload: body,
+	}, func() error {
+		return handle(dn)
+	})
+}
+
 // https://developer.android.com/google/play/billing/rtdn-reference
 type DeveloperNotification struct {
 	Version                    string                     `json:"version"`
@@ -139,3 +163,16 @@ type SubscriptionNotification struct {
 type TestNotification struct {
 	Version string `json:"version"`
 }
+
+// notificationType 通知类型, 如SUBSCRIPTION_RENEWED
+func (dn *DeveloperNotification) notificationType() string {
+	switch {
+	case dn.SubscriptionNotification.NotificationType != 0:
+		return PlayStoreNotifyType(dn.SubscriptionNotification.NotificationType)
+	case dn.OneTimeProductNotification.NotificationType == ONE_TIME_PRODUCT_PURCHASED:
+		return "ONE_TIME_PRODUCT_PURCHASED"
+	case dn.OneTimeProductNotification.NotificationType == ONE_TIME_PRODUCT_CANCELED:
+		return "ONE_TIME_PRODUCT_CANCELED"
+	}
+	return "TEST"
+}
@@ -183,7 +183,7 @@ func (oa *GoogleOauth2Config) GetAccessToken() (*oauth2.Token, error) {
 		if code, _ := cli.GetAuthCode(); code != "" {
 			token, err = cli.GetAccessToken(code)
 		} else {
-			err = errors.New("get auth code failed")
+			err = errors.New("unigoogle: get auth code failed")
 		}
 	}
 	if err == nil {
@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/lovewith99/unipay"
 	"google.golang.org/api/androidpublisher/v3"
 )
 
@@ -40,12 +41,18 @@ var RemoteAndroidPublisherApis = AndroidPublisherApis{
 	RevokeSubscription: "/google/iap/revokeSubscription",
 }
 
+// ErrorResponse 将代理服务的错误响应转换为unipay.ProviderError, 5xx为可重试的错误
 func ErrorResponse(resp *http.Response) error {
-	data := make(map[string]interface{})
+	pe := &unipay.ProviderError{
+		PayWay:    unipay.PayWay_PlayStore,
+		Code:      strconv.Itoa(resp.StatusCode),
+		Message:   resp.Status,
+		Retryable: resp.StatusCode >= http.StatusInternalServerError,
+	}
 
-	err := json.NewDecoder(resp.Body).Decode(&data)
-	if err != nil {
-		return err
+	data := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return pe
 	}
 
 	msg := "Error:"
@@ -54,7 +61,8 @@ func ErrorResponse(resp *http.Response) error {
 		msg += item
 	}
 
-	return errors.New(msg)
+	pe.Message = msg
+	return pe
 }
 
 func (svc RemoteAndroidPublisherService) Do(req *http.Request, result interface{}) error {
@@ -0,0 +1,351 @@
+package unipaypal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lovewith99/unipay"
+	paypal "github.com/plutov/paypal/v4"
+)
+
+// 订单意图
+const (
+	IntentCapture   = "CAPTURE"   // 用户同意支付后立即扣款
+	IntentAuthorize = "AUTHORIZE" // 用户同意支付后先授权, 发货时再扣款
+)
+
+// paypal订单状态 https://developer.paypal.com/docs/api/orders/v2/#orders_capture
+const (
+	OrderStatusCompleted           = "COMPLETED"
+	OrderStatusPayerActionRequired = "PAYER_ACTION_REQUIRED"
+	OrderStatusVoided              = "VOIDED"
+)
+
+// paypal扣款状态 https://developer.paypal.com/docs/api/payments/v2/#definition-capture_status
+const (
+	CaptureStatusCompleted = "COMPLETED"
+	CaptureStatusPending   = "PENDING"
+	CaptureStatusDeclined  = "DECLINED"
+	CaptureStatusFailed    = "FAILED"
+)
+
+// paypal授权状态 https://developer.paypal.com/docs/api/payments/v2/#definition-authorization_status
+const (
+	AuthorizationStatusCreated = "CREATED"
+	AuthorizationStatusPending = "PENDING"
+	AuthorizationStatusDenied  = "DENIED"
+	AuthorizationStatusVoided  = "VOIDED"
+)
+
+// Capture/Authorize返回的订单状态
+const (
+	StatusPaid                = "paid"                  // 扣款成功, 订单已处理
+	StatusAuthorized          = "authorized"            // 授权成功, 等待CaptureAuthorization扣款
+	StatusPending             = "pending"               // 扣款处理中, 结果以webhook通知为准
+	StatusPayerActionRequired = "payer_action_required" // 需要用户完成额外的验证(如3DS), 引导用户打开payer_action_url
+	StatusVoided              = "voided"                // 订单或授权已作废
+	StatusFailed              = "failed"                // 扣款或授权被拒绝
+)
+
+// orderResp 扣款/授权的订单结果, paypal.CaptureOrderResponse 缺少invoice_id和扣款状态
+type orderResp struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	PurchaseUnits []struct {
+		ReferenceID string `json:"reference_id"`
+		InvoiceID   string `json:"invoice_id"`
+		Payments    *struct {
+			Captures       []capture `json:"captures"`
+			Authorizations []capture `json:"authorizations"`
+		} `json:"payments"`
+	} `json:"purchase_units"`
+	Links []paypal.Link `json:"links"`
+}
+
+// capture 扣款或授权信息
+type capture struct {
+	ID             string        `json:"id"`
+	Status         string        `json:"status"`
+	InvoiceID      string        `json:"invoice_id"`
+	CustomID       string        `json:"custom_id"`
+	Amount         *paypal.Money `json:"amount"`
+	ExpirationTime string        `json:"expiration_time,omitempty"`
+}
+
+// payment 返回第一个purchase unit的扣款或授权信息, invoice_id优先取扣款上的值
+func (resp *orderResp) payment(authorization bool) (*capture, error) {
+	for _, unit := range resp.PurchaseUnits {
+		if unit.Payments == nil {
+			continue
+		}
+
+		payments := unit.Payments.Captures
+		if authorization {
+			payments = unit.Payments.Authorizations
+		}
+		if len(payments) == 0 {
+			continue
+		}
+
+		c := payments[0]
+		if c.InvoiceID == "" {
+			c.InvoiceID = unit.InvoiceID
+		}
+		return &c, nil
+	}
+
+	return nil, errors.New("unipaypal: payment not found: " + resp.ID)
+}
+
+func (resp *orderResp) link(rel string) string {
+	for _, e := range resp.Links {
+		if e.Rel == rel {
+			return e.Href
+		}
+	}
+	return ""
+}
+
+// result 根据订单状态返回结果, 订单未完成时done为false
+func (resp *orderResp) result() (result unipay.MapResult, done bool, err error) {
+	result = unipay.MapResult{
+		"id": resp.ID,
+	}
+
+	switch resp.Status {
+	case OrderStatusCompleted:
+		return result, true, nil
+	case OrderStatusPayerActionRequired:
+		result["status"] = StatusPayerActionRequired
+		result["payer_action_url"] = resp.link("payer-action")
+		return result, false, nil
+	case OrderStatusVoided:
+		result["status"] = StatusVoided
+		return result, false, nil
+	}
+
+	return nil, false, fmt.Errorf("unipaypal: checkout order status: %s", resp.Status)
+}
+
+// send 调用paypal接口, requestId不为空时作为PayPal-Request-Id保证幂等
+func (cli *Client) send(method, path string, payload, result interface{}, requestId string) error {
+	if _, err := cli.GetAccessToken(); err != nil {
+		return err
+	}
+
+	c := cli.client
+	req, err := c.NewRequest(context.Background(), method, c.APIBase+path, payload)
+	if err != nil {
+		return err
+	}
+
+	if requestId != "" {
+		req.Header.Set("PayPal-Request-Id", requestId)
+	}
+
+	return respError(c.SendWithAuth(req, result))
+}
+
+// respError 将paypal返回的错误转换为unipay.ProviderError, 5xx和频率限制为可重试的错误
+func respError(err error) error {
+	var resp *paypal.ErrorResponse
+	if !errors.As(err, &resp) {
+		return err
+	}
+
+	pe := &unipay.ProviderError{
+		PayWay:  unipay.PayWay_Paypal,
+		Code:    resp.Name,
+		Message: resp.Message,
+	}
+	if len(resp.Details) > 0 && resp.Details[0].Issue != "" {
+		// 如INSTRUMENT_DECLINED, 比name更具体
+		pe.Code = resp.Details[0].Issue
+	}
+	if resp.Response != nil {
+		status := resp.Response.StatusCode
+		pe.Retryable = status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+	}
+	return pe
+}
+
+// Capture 用户同意支付后扣款, 扣款成功时校验金额和币种并执行OrderService.Invoke
+// 同一个paypal订单重复调用时, paypal根据PayPal-Request-Id返回第一次扣款的结果
+func (cli *Client) Capture(orderId string) (unipay.MapResult, error) {
+	var resp orderResp
+	err := cli.send(http.MethodPost, "/v2/checkout/orders/"+orderId+"/capture",
+		paypal.CaptureOrderRequest{}, &resp, "capture-"+orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	result, done, err := resp.result()
+	if !done {
+		return result, err
+	}
+
+	cp, err := resp.payment(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli.captured(cp, result)
+}
+
+// captured 处理扣款结果, 扣款成功时执行Invoke
+func (cli *Client) captured(cp *capture, result unipay.MapResult) (unipay.MapResult, error) {
+	result["capture_id"] = cp.ID
+	result["out_trade_no"] = cp.InvoiceID
+
+	switch cp.Status {
+	case CaptureStatusCompleted:
+	case CaptureStatusPending:
+		result["status"] = StatusPending
+		return result, nil
+	default:
+		result["status"] = StatusFailed
+		return result, nil
+	}
+
+	order, err := cli.OrderService.GetOrderByTradeNo(cp.InvoiceID, unipay.PayWay_Paypal)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkAmount(order.OrderInfo(), cp.Amount); err != nil {
+		return nil, err
+	}
+
+	if err := cli.Invoke(cp.InvoiceID); err != nil {
+		return nil, err
+	}
+
+	result["status"] = StatusPaid
+	return result, nil
+}
+
+// Authorize AUTHORIZE意图的订单在用户同意支付后授权, 授权成功后在发货时调用CaptureAuthorization扣款
+// 授权不会执行Invoke, 返回的authorization_id需要与订单一起保存
+func (cli *Client) Authorize(orderId string) (unipay.MapResult, error) {
+	var resp orderResp
+	err := cli.send(http.MethodPost, "/v2/checkout/orders/"+orderId+"/authorize",
+		struct{}{}, &resp, "authorize-"+orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	result, done, err := resp.result()
+	if !done {
+		return result, err
+	}
+
+	auth, err := resp.payment(true)
+	if err != nil {
+		return nil, err
+	}
+
+	result["authorization_id"] = auth.ID
+	result["out_trade_no"] = auth.InvoiceID
+	result["expiration_time"] = auth.ExpirationTime
+
+	switch auth.Status {
+	case AuthorizationStatusCreated:
+	case AuthorizationStatusPending:
+		result["status"] = StatusPending
+		return result, nil
+	default:
+		result["status"] = StatusFailed
+		return result, nil
+	}
+
+	order, err := cli.OrderService.GetOrderByTradeNo(auth.InvoiceID, unipay.PayWay_Paypal)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkAmount(order.OrderInfo(), auth.Amount); err != nil {
+		return nil, err
+	}
+
+	result["status"] = StatusAuthorized
+	return result, nil
+}
+
+// CaptureAuthorization 对授权全额扣款, 扣款成功时校验金额和币种并执行OrderService.Invoke
+func (cli *Client) CaptureAuthorization(authorizationId string) (unipay.MapResult, error) {
+	var cp capture
+	err := cli.send(http.MethodPost, "/v2/payments/authorizations/"+authorizationId+"/capture",
+		paypal.PaymentCaptureRequest{FinalCapture: true}, &cp, "capture-"+authorizationId)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli.captured(&cp, unipay.MapResult{
+		"authorization_id": authorizationId,
+	})
+}
+
+// VoidAuthorization 作废授权, 用于取消未发货的订单
+func (cli *Client) VoidAuthorization(authorizationId string) error {
+	// paypal.Client.VoidAuthorization 无法处理204的空响应
+	return cli.send(http.MethodPost, "/v2/payments/authorizations/"+authorizationId+"/void",
+		nil, nil, "void-"+authorizationId)
+}
+
+// checkAmount 校验扣款金额和币种与订单一致
+func checkAmount(info *unipay.OrderInfo, amount *paypal.Money) error {
+	if amount == nil {
+		return fmt.Errorf("%w: capture amount missing %s", unipay.ErrAmountMismatch, info.OutTradeNo)
+	}
+
+	if !strings.EqualFold(amount.Currency, info.Currency) {
+		return fmt.Errorf("%w: currency %s", unipay.ErrAmountMismatch, info.OutTradeNo)
+	}
+
+	paid, err := unipay.ParseMoney(amount.Value, amount.Currency)
+	if err != nil {
+		return err
+	}
+
+	if !paid.Equal(info.Money()) {
+		return fmt.Errorf("%w: %s", unipay.ErrAmountMismatch, info.OutTradeNo)
+	}
+
+	return nil
+}
+
+// toMoney 转换为paypal金额
+func toMoney(m unipay.Money) *paypal.Money {
+	return &paypal.Money{
+		Currency: m.Currency,
+		Value:    m.String(),
+	}
+}
+
+// Invoke 处理已支付的订单
+func (cli *Client) Invoke(outTradeNo string) error {
+	unlock, err := unipay.AcquireLock(cli.Locker, outTradeNo, cli.LockOptions)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	svc := cli.OrderService
+	order, err := svc.GetOrderByTradeNo(outTradeNo, unipay.PayWay_Paypal)
+	if err != nil {
+		return err
+	}
+
+	if err := unipay.CheckTransition(order, unipay.OrderEventPay); err != nil {
+		// 订单已处理，直接返回
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	return svc.Invoke(order)
+}
@@ -3,6 +3,8 @@ package unipaypal
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"sync"
 
 	"github.com/lovewith99/unipay"
 	paypal "github.com/plutov/paypal/v4"
@@ -12,7 +14,20 @@ type Client struct {
 	Config
 	client *paypal.Client
 
+	Locker       unipay.Locker
+	LockOptions  unipay.LockOptions
 	OrderService unipay.OrderService
+	CertFetcher  CertFetcher
+	TokenStore   TokenStore
+
+	NotificationStore unipay.NotificationStore
+	RequestSigner     *unipay.RequestSigner
+
+	SubscriptionService SubscriptionService
+
+	tokenMu   sync.RWMutex
+	token     *Token
+	refreshMu sync.Mutex
 }
 
 type ClientOption func(*Client)
@@ -30,6 +45,58 @@ func WithOrderService(svc unipay.OrderService) ClientOption {
 	}
 }
 
+func WithLocker(locker unipay.Locker) ClientOption {
+	return func(cli *Client) {
+		cli.Locker = locker
+	}
+}
+
+// WithRequestSigner Payment和CreateSubscription创建订单前校验客户端请求签名
+func WithRequestSigner(signer *unipay.RequestSigner) ClientOption {
+	return func(cli *Client) {
+		cli.RequestSigner = signer
+	}
+}
+
+// WithLockOptions 处理扣款/退款/订阅扣款时订单锁的过期时间和等待时间
+func WithLockOptions(opts unipay.LockOptions) ClientOption {
+	return func(cli *Client) {
+		cli.LockOptions = opts
+	}
+}
+
+// Webhook 配置webhook id, 在paypal开发者后台创建webhook时生成
+func Webhook(webhookId string) ClientOption {
+	return func(cli *Client) {
+		cli.WebhookID = webhookId
+	}
+}
+
+// OfflineVerify 使用证书离线验证webhook签名, 不再调用verify-webhook-signature接口
+// fetcher为nil时使用NewCertFetcher(nil)
+func OfflineVerify(fetcher CertFetcher) ClientOption {
+	return func(cli *Client) {
+		if fetcher == nil {
+			fetcher = NewCertFetcher(nil)
+		}
+		cli.CertFetcher = fetcher
+	}
+}
+
+// WithNotificationStore webhook事件去重并保存原始报文, 默认使用进程内的unipay.MemoryNotificationStore
+func WithNotificationStore(store unipay.NotificationStore) ClientOption {
+	return func(cli *Client) {
+		cli.NotificationStore = store
+	}
+}
+
+// WithTokenStore 多个服务实例共享access token
+func WithTokenStore(store TokenStore) ClientOption {
+	return func(cli *Client) {
+		cli.TokenStore = store
+	}
+}
+
 func NewClient(prod bool, clientId, secret string, opts ...ClientOption) (*Client, error) {
 	var err error
 	client := &Client{}
@@ -41,6 +108,18 @@ func NewClient(prod bool, clientId, secret string, opts ...ClientOption) (*Clien
 		opt(client)
 	}
 
+	if client.Intent == "" {
+		client.Intent = IntentCapture
+	}
+
+	if client.Locker == nil {
+		client.Locker = unipay.LockerImpl{}
+	}
+
+	if client.NotificationStore == nil {
+		client.NotificationStore = unipay.NewMemoryNotificationStore()
+	}
+
 	apiBase := paypal.APIBaseSandBox
 	if client.IsProd {
 		apiBase = paypal.APIBaseLive
@@ -50,69 +129,86 @@ func NewClient(prod bool, clientId, secret string, opts ...ClientOption) (*Clien
 	if err != nil {
 		return nil, err
 	}
+	// 接口返回完整的资源, 只在初始化时设置, 避免并发请求时修改共享的client
+	client.client.SetReturnRepresentation()
 
 	return client, nil
 }
 
-func (cli *Client) Client() *paypal.Client {
-	return cli.client
+// WithSubscriptionService 订阅状态变更的处理接口
+func WithSubscriptionService(svc SubscriptionService) ClientOption {
+	return func(cli *Client) {
+		cli.SubscriptionService = svc
+	}
 }
 
-func (cli *Client) GetAccessToken() (*paypal.TokenResponse, error) {
-	c := cli.client
-
-	if c.Token != nil {
-		return c.Token, nil
+// WithApplicationContext 配置支付页面的商户名称/语言/着陆页等
+func WithApplicationContext(appCtx ApplicationContext) ClientOption {
+	return func(cli *Client) {
+		cli.ApplicationContext = appCtx
 	}
+}
 
-	c.Lock()
-	defer c.Unlock()
+// Intent 配置订单意图, 默认IntentCapture; 实物商品发货时扣款使用IntentAuthorize
+func Intent(intent string) ClientOption {
+	return func(cli *Client) {
+		cli.Intent = intent
+	}
+}
 
-	return c.GetAccessToken(context.Background())
+func (cli *Client) Client() *paypal.Client {
+	return cli.client
 }
 
+// CreateOrder 创建paypal订单, order实现了OrderDetail时使用订单明细生成商品/税费/运费/折扣
 func (cli *Client) CreateOrder(ctx *unipay.Context, order unipay.IOrder) (*paypal.Order, error) {
-	// info := cli.OrderInfo(order)
 	info := order.OrderInfo()
-	amount := fmt.Sprintf("%.2f", float64(info.TotalFee)/100)
 
-	c := cli.client
-	purchaseUnits := []paypal.PurchaseUnitRequest{
-		{
-			InvoiceID: info.OutTradeNo,
-			CustomID:  info.Attach,
-			Amount: &paypal.PurchaseUnitAmount{
-				Currency: info.Currency,
-				Value:    amount,
-				Breakdown: &paypal.PurchaseUnitAmountBreakdown{
-					ItemTotal: &paypal.Money{
-						Currency: info.Currency,
-						Value:    amount,
-					},
-				},
-			},
-			Items: []paypal.Item{
-				{
-					Name:     info.Subject,
-					Quantity: "1",
-					UnitAmount: &paypal.Money{
-						Currency: info.Currency,
-						Value:    amount,
-					},
-				},
-			},
-		},
-	}
-	payer := &paypal.CreateOrderPayer{}
-	appCtx := &paypal.ApplicationContext{
-		ReturnURL: cli.ReturnURL,
-		CancelURL: cli.CancelURL,
-	}
-
-	return c.CreateOrder(context.Background(), "CAPTURE", purchaseUnits, payer, appCtx)
+	detail := &Detail{}
+	if od, ok := order.(OrderDetail); ok {
+		if d := od.OrderDetail(ctx); d != nil {
+			detail = d
+		}
+	}
+
+	unit, err := purchaseUnit(info, detail)
+	if err != nil {
+		return nil, err
+	}
+
+	appCtx := &applicationContext{
+		BrandName:          cli.ApplicationContext.BrandName,
+		Locale:             cli.ApplicationContext.Locale,
+		LandingPage:        cli.ApplicationContext.LandingPage,
+		UserAction:         cli.ApplicationContext.UserAction,
+		ShippingPreference: cli.ApplicationContext.ShippingPreference,
+		ReturnURL:          cli.ReturnURL,
+		CancelURL:          cli.CancelURL,
+	}
+	if detail.Locale != "" {
+		appCtx.Locale = detail.Locale
+	}
+
+	req := createOrderReq{
+		Intent:             cli.Intent,
+		Payer:              detail.Payer.createOrderPayer(),
+		PurchaseUnits:      []paypal.PurchaseUnitRequest{*unit},
+		ApplicationContext: appCtx,
+	}
+
+	var resp paypal.Order
+	if err := cli.send(http.MethodPost, "/v2/checkout/orders", req, &resp, ""); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
 }
 
 func (cli *Client) Payment(ctx *unipay.Context) (unipay.MapResult, error) {
+	if err := cli.RequestSigner.Verify(&ctx.Request); err != nil {
+		return nil, err
+	}
+
 	// paypal.PaymentPayer
 	svc := cli.OrderService
 
@@ -121,11 +217,6 @@ func (cli *Client) Payment(ctx *unipay.Context) (unipay.MapResult, error) {
 		return nil, err
 	}
 
-	_, err = cli.GetAccessToken()
-	if err != nil {
-		return nil, err
-	}
-
 	// 创建paypel订单
 	pporder, err := cli.CreateOrder(ctx, order)
 	if err != nil {
@@ -133,7 +224,7 @@ func (cli *Client) Payment(ctx *unipay.Context) (unipay.MapResult, error) {
 	}
 
 	if pporder.Status != "CREATED" {
-		return nil, fmt.Errorf("paypal checkout order status: %s", pporder.Status)
+		return nil, fmt.Errorf("unipaypal: checkout order status: %s", pporder.Status)
 	}
 
 	result := unipay.MapResult{
@@ -153,6 +244,7 @@ func (cli *Client) Payment(ctx *unipay.Context) (unipay.MapResult, error) {
 	return result, nil
 }
 
+// CapturePaymentOrder 扣款并返回paypal的原始结果, 不处理订单; 需要处理订单时使用Capture
 func (cli *Client) CapturePaymentOrder(orderId string) (*paypal.CaptureOrderResponse, error) {
 	_, err := cli.GetAccessToken()
 	if err != nil {
@@ -163,7 +255,7 @@ func (cli *Client) CapturePaymentOrder(orderId string) (*paypal.CaptureOrderResp
 	capture := paypal.CaptureOrderRequest{}
 	resp, err := c.CaptureOrder(context.Background(), orderId, capture)
 	if err != nil {
-		return nil, err
+		return nil, respError(err)
 	}
 
 	// 1. CREATED. The order was created with the specified context.
@@ -183,3 +275,13 @@ func (cli *Client) CapturePaymentOrder(orderId string) (*paypal.CaptureOrderResp
 
 	return resp, nil
 }
+
+// GetOrder 查询paypal订单详情, 用于对账或在未收到webhook时确认订单状态
+func (cli *Client) GetOrder(orderId string) (*paypal.Order, error) {
+	if _, err := cli.GetAccessToken(); err != nil {
+		return nil, err
+	}
+
+	order, err := cli.client.GetOrder(context.Background(), orderId)
+	return order, respError(err)
+}
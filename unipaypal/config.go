@@ -7,4 +7,9 @@ type Config struct {
 
 	ReturnURL string
 	CancelURL string
+
+	ApplicationContext ApplicationContext // 支付页面配置
+
+	Intent    string // 订单意图, IntentCapture | IntentAuthorize
+	WebhookID string // webhook id, 验证webhook签名时使用
 }
@@ -0,0 +1,183 @@
+package unipaypal
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/lovewith99/unipay"
+	paypal "github.com/plutov/paypal/v4"
+)
+
+// 商品类别
+const (
+	CategoryDigitalGoods  = "DIGITAL_GOODS"
+	CategoryPhysicalGoods = "PHYSICAL_GOODS"
+	CategoryDonation      = "DONATION"
+)
+
+// 支付页面的着陆页
+const (
+	LandingPageLogin   = "LOGIN"
+	LandingPageBilling = "BILLING"
+	LandingPageNoPref  = "NO_PREFERENCE"
+)
+
+// Item 订单中的商品
+type Item struct {
+	Name        string // 商品名称
+	Description string // 商品描述
+	SKU         string // 商品编号
+	Category    string // 商品类别, CategoryDigitalGoods | CategoryPhysicalGoods | CategoryDonation
+	Quantity    int    // 数量, 0视为1
+	UnitAmount  int    // 单价, 以最小单位计
+	Tax         int    // 单件税费, 以最小单位计
+}
+
+// Payer 预填的付款人信息
+type Payer struct {
+	Email     string
+	GivenName string
+	Surname   string
+}
+
+// Detail paypal订单明细
+// 商品总价 + 税费 + 运费 + 手续费 + 保险费 - 折扣 - 运费折扣 需要等于OrderInfo.TotalFee
+// Items为空时使用OrderInfo.Subject作为唯一商品, 单价由TotalFee倒推
+type Detail struct {
+	Description      string // 订单描述
+	Items            []Item
+	Shipping         int                    // 运费, 以最小单位计
+	Handling         int                    // 手续费, 以最小单位计
+	Insurance        int                    // 保险费, 以最小单位计
+	Discount         int                    // 折扣, 以最小单位计
+	ShippingDiscount int                    // 运费折扣, 以最小单位计
+	ShippingAddress  *paypal.ShippingDetail // 收货地址, ShippingPreference为SET_PROVIDED_ADDRESS时使用
+	Payer            *Payer                 // 预填的付款人信息
+	Locale           string                 // 支付页面语言, 为空时使用ApplicationContext.Locale
+}
+
+// OrderDetail paypal订单明细, IOrder可选实现
+// 未实现时订单只包含一件名称为OrderInfo.Subject的商品
+type OrderDetail interface {
+	OrderDetail(ctx *unipay.Context) *Detail
+}
+
+// ApplicationContext 支付页面的配置
+type ApplicationContext struct {
+	BrandName          string // 支付页面展示的商户名称
+	Locale             string // 支付页面语言, 如"en-US"
+	LandingPage        string // LandingPageLogin | LandingPageBilling | LandingPageNoPref
+	UserAction         string // CONTINUE: 返回商户确认后扣款 | PAY_NOW: 在paypal页面直接完成支付
+	ShippingPreference string // GET_FROM_FILE | NO_SHIPPING | SET_PROVIDED_ADDRESS
+}
+
+// applicationContext paypal.ApplicationContext 缺少landing_page
+type applicationContext struct {
+	BrandName          string `json:"brand_name,omitempty"`
+	Locale             string `json:"locale,omitempty"`
+	LandingPage        string `json:"landing_page,omitempty"`
+	UserAction         string `json:"user_action,omitempty"`
+	ShippingPreference string `json:"shipping_preference,omitempty"`
+	ReturnURL          string `json:"return_url,omitempty"`
+	CancelURL          string `json:"cancel_url,omitempty"`
+}
+
+// createOrderReq 创建订单的请求
+type createOrderReq struct {
+	Intent             string                       `json:"intent"`
+	Payer              *paypal.CreateOrderPayer     `json:"payer,omitempty"`
+	PurchaseUnits      []paypal.PurchaseUnitRequest `json:"purchase_units"`
+	ApplicationContext *applicationContext          `json:"application_context,omitempty"`
+}
+
+// purchaseUnit 根据订单明细生成purchase unit, 明细金额之和与订单金额不一致时返回错误
+func purchaseUnit(info *unipay.OrderInfo, detail *Detail) (*paypal.PurchaseUnitRequest, error) {
+	money := func(fee int) *paypal.Money {
+		return toMoney(unipay.NewMoney(int64(fee), info.Currency))
+	}
+	optional := func(fee int) *paypal.Money {
+		if fee == 0 {
+			return nil
+		}
+		return money(fee)
+	}
+
+	items := detail.Items
+	if len(items) == 0 {
+		items = []Item{
+			{
+				Name:       info.Subject,
+				Quantity:   1,
+				UnitAmount: info.TotalFee - detail.Shipping - detail.Handling - detail.Insurance + detail.Discount + detail.ShippingDiscount,
+			},
+		}
+	}
+
+	var itemTotal, taxTotal int
+	unit := &paypal.PurchaseUnitRequest{
+		InvoiceID:   info.OutTradeNo,
+		CustomID:    info.Attach,
+		Description: detail.Description,
+		Shipping:    detail.ShippingAddress,
+	}
+
+	for _, item := range items {
+		quantity := item.Quantity
+		if quantity <= 0 {
+			quantity = 1
+		}
+
+		itemTotal += item.UnitAmount * quantity
+		taxTotal += item.Tax * quantity
+
+		unit.Items = append(unit.Items, paypal.Item{
+			Name:        item.Name,
+			Description: item.Description,
+			SKU:         item.SKU,
+			Category:    item.Category,
+			Quantity:    strconv.Itoa(quantity),
+			UnitAmount:  money(item.UnitAmount),
+			Tax:         optional(item.Tax),
+		})
+	}
+
+	total := itemTotal + taxTotal + detail.Shipping + detail.Handling + detail.Insurance -
+		detail.Discount - detail.ShippingDiscount
+	if total != info.TotalFee {
+		return nil, fmt.Errorf("%w: paypal breakdown %s", unipay.ErrAmountMismatch, info.OutTradeNo)
+	}
+
+	unit.Amount = &paypal.PurchaseUnitAmount{
+		Currency: info.Currency,
+		Value:    money(info.TotalFee).Value,
+		Breakdown: &paypal.PurchaseUnitAmountBreakdown{
+			ItemTotal:        money(itemTotal),
+			TaxTotal:         optional(taxTotal),
+			Shipping:         optional(detail.Shipping),
+			Handling:         optional(detail.Handling),
+			Insurance:        optional(detail.Insurance),
+			Discount:         optional(detail.Discount),
+			ShippingDiscount: optional(detail.ShippingDiscount),
+		},
+	}
+
+	return unit, nil
+}
+
+func (p *Payer) createOrderPayer() *paypal.CreateOrderPayer {
+	if p == nil {
+		return nil
+	}
+
+	payer := &paypal.CreateOrderPayer{
+		EmailAddress: p.Email,
+	}
+	if p.GivenName != "" || p.Surname != "" {
+		payer.Name = &paypal.CreateOrderPayerName{
+			GivenName: p.GivenName,
+			Surname:   p.Surname,
+		}
+	}
+
+	return payer
+}
@@ -0,0 +1,187 @@
+package unipaypal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lovewith99/unipay"
+	paypal "github.com/plutov/paypal/v4"
+)
+
+// paypal退款状态 https://developer.paypal.com/docs/api/payments/v2/#definition-refund_status
+const (
+	RefundStatusCompleted = "COMPLETED"
+	RefundStatusPending   = "PENDING"
+	RefundStatusCancelled = "CANCELLED"
+	RefundStatusFailed    = "FAILED"
+)
+
+// Refund paypal退款结果
+type Refund struct {
+	ID         string // paypal退款id
+	CaptureID  string // paypal扣款id
+	OutTradeNo string // 商户订单号
+	RefundFee  int    // 本次退款金额
+	Status     string // 退款状态, RefundStatusCompleted | RefundStatusPending | ...
+}
+
+// refundReq 退款请求, amount为空时全额退款
+type refundReq struct {
+	Amount    *paypal.Money `json:"amount,omitempty"`
+	InvoiceID string        `json:"invoice_id,omitempty"`
+}
+
+// Refund 对扣款退款, amount为0时退还剩余全部金额
+// 退款完成时, 累计退款金额达到订单金额调用OrderService.Revoke
+// 部分退款时, OrderService实现了unipay.PartialRefundService则调用PartialRefund
+// refundNo为商户退款单号, 每笔退款唯一, 与扣款id一起作为PayPal-Request-Id, 相同refundNo重复调用不会重复退款
+// 未支付或已全额退款的订单返回unipay.ErrOrderNotPaid | unipay.ErrOrderRefunded
+func (cli *Client) Refund(captureId string, amount int, refundNo string) (*Refund, error) {
+	if refundNo == "" {
+		return nil, errors.New("unipaypal: refund no required")
+	}
+
+	var cp capture
+	err := cli.send(http.MethodGet, "/v2/payments/captures/"+captureId, nil, &cp, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if cp.InvoiceID == "" {
+		return nil, errors.New("unipaypal: capture invoice_id missing: " + captureId)
+	}
+
+	order, err := cli.OrderService.GetOrderByTradeNo(cp.InvoiceID, unipay.PayWay_Paypal)
+	if err != nil {
+		return nil, err
+	}
+
+	event := unipay.OrderEventRefund
+	if amount > 0 && amount < order.OrderInfo().TotalFee {
+		event = unipay.OrderEventPartialRefund
+	}
+
+	// 未支付或已全额退款的订单不能退款
+	if err := unipay.CheckTransition(order, event); err != nil {
+		return nil, err
+	}
+
+	req := refundReq{
+		InvoiceID: cp.InvoiceID,
+	}
+
+	if amount > 0 {
+		if cp.Amount == nil {
+			return nil, fmt.Errorf("%w: capture amount missing %s", unipay.ErrAmountMismatch, captureId)
+		}
+
+		req.Amount = toMoney(unipay.NewMoney(int64(amount), cp.Amount.Currency))
+	}
+
+	var resource refundResource
+	err = cli.send(http.MethodPost, "/v2/payments/captures/"+captureId+"/refund",
+		req, &resource, "refund-"+captureId+"-"+refundNo)
+	if err != nil {
+		return nil, err
+	}
+
+	if resource.InvoiceID == "" {
+		resource.InvoiceID = cp.InvoiceID
+	}
+
+	refundFee, err := parseAmount(resource.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	refund := &Refund{
+		ID:         resource.ID,
+		CaptureID:  captureId,
+		OutTradeNo: resource.InvoiceID,
+		RefundFee:  refundFee,
+		Status:     resource.Status,
+	}
+
+	// 退款处理中时, 结果由PAYMENT.CAPTURE.REFUNDED通知处理
+	if resource.Status == RefundStatusCompleted {
+		if err := cli.refunded(&resource, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return refund, nil
+}
+
+// refunded 处理退款和撤销(拒付等), 撤销视为全额退款
+// 退款通知中没有invoice_id时, 通过退款对应的扣款获取
+func (cli *Client) refunded(resource *refundResource, reversed bool) error {
+	outTradeNo := resource.InvoiceID
+	if outTradeNo == "" {
+		captureId := resource.captureID()
+		if captureId == "" {
+			return errors.New("unipaypal: invoice_id missing: " + resource.ID)
+		}
+
+		var cp capture
+		if err := cli.send(http.MethodGet, "/v2/payments/captures/"+captureId, nil, &cp, ""); err != nil {
+			return err
+		}
+		if cp.InvoiceID == "" {
+			return errors.New("unipaypal: capture invoice_id missing: " + captureId)
+		}
+		outTradeNo = cp.InvoiceID
+	}
+
+	unlock, err := unipay.AcquireLock(cli.Locker, outTradeNo, cli.LockOptions)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	svc := cli.OrderService
+	order, err := svc.GetOrderByTradeNo(outTradeNo, unipay.PayWay_Paypal)
+	if err != nil {
+		return err
+	}
+
+	event := unipay.OrderEventRefund
+	if !reversed {
+		// 累计退款金额达到订单金额时为全额退款
+		total := resource.Amount
+		if b := resource.SellerPayableBreakdown; b != nil && b.TotalRefundedAmount != nil {
+			total = b.TotalRefundedAmount
+		}
+
+		refunded, err := parseAmount(total)
+		if err != nil {
+			return err
+		}
+
+		if refunded < order.OrderInfo().TotalFee {
+			event = unipay.OrderEventPartialRefund
+		}
+	}
+
+	if err := unipay.CheckTransition(order, event); err != nil {
+		// 订单已退款，直接返回; 未支付的订单不能退款
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	if event == unipay.OrderEventRefund {
+		return svc.Revoke(order)
+	}
+
+	if partial, ok := svc.(unipay.PartialRefundService); ok {
+		refundFee, err := parseAmount(resource.Amount)
+		if err != nil {
+			return err
+		}
+		return partial.PartialRefund(order, resource.ID, refundFee)
+	}
+
+	return nil
+}
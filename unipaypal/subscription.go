@@ -0,0 +1,534 @@
+package unipaypal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/lovewith99/unipay"
+	paypal "github.com/plutov/paypal/v4"
+)
+
+// 订阅周期单位
+const (
+	IntervalDay   = "DAY"
+	IntervalWeek  = "WEEK"
+	IntervalMonth = "MONTH"
+	IntervalYear  = "YEAR"
+)
+
+// paypal订阅状态 https://developer.paypal.com/docs/api/subscriptions/v1/#subscriptions_get
+const (
+	SubscriptionStatusApprovalPending = "APPROVAL_PENDING"
+	SubscriptionStatusApproved        = "APPROVED"
+	SubscriptionStatusActive          = "ACTIVE"
+	SubscriptionStatusSuspended       = "SUSPENDED"
+	SubscriptionStatusCancelled       = "CANCELLED"
+	SubscriptionStatusExpired         = "EXPIRED"
+)
+
+// Plan 订阅计划参数
+type Plan struct {
+	ProductID     string // paypal产品id, 由CreateProduct创建
+	Name          string // 计划名称
+	Description   string // 计划描述
+	Currency      string // 货币单位
+	Price         int    // 每期金额, 以最小单位计
+	IntervalUnit  string // 周期单位, IntervalDay | IntervalWeek | IntervalMonth | IntervalYear
+	IntervalCount int    // 周期数, 与IntervalUnit组合为扣款周期
+	TotalCycles   int    // 扣款期数, 0表示不限期数直到取消
+	TrialPrice    int    // 试用期每期金额, 以最小单位计, 0表示免费试用
+	TrialCycles   int    // 试用期数, 0表示没有试用期
+}
+
+// Subscription paypal订阅
+type Subscription struct {
+	ID              string // paypal订阅id
+	PlanID          string // paypal计划id
+	Status          string // 订阅状态, SubscriptionStatusActive | ...
+	OutTradeNo      string // 创建订阅时的商户订单号
+	PayerID         string // paypal用户id
+	Email           string // paypal用户邮箱
+	StartTime       string // 订阅开始时间
+	NextBillingTime string // 下次扣款时间
+}
+
+// SubscriptionSale 订阅的扣款记录, 续费时作为ctx.InApp传给OrderService.PostOrder
+// 每期扣款的第三方交易流水号为ID, 首期订单Invoke时OrderInfo().TradeNo为ID
+// OrderService需要保存TradeNo, GetOrderByTradeNo需要支持按ID查询订单
+type SubscriptionSale struct {
+	ID             string // paypal扣款id
+	SubscriptionID string // paypal订阅id
+	OutTradeNo     string // 创建订阅时的商户订单号
+	TotalFee       int    // 扣款金额, 以最小单位计
+	Currency       string // 货币单位
+}
+
+// SubscriptionService 订阅状态变更的处理接口
+// 未配置时若OrderService实现了该接口则使用OrderService
+// 每期扣款与IAP续费一样, 由PAYMENT.SALE.*通知走OrderService的Invoke/Revoke流程
+type SubscriptionService interface {
+	// Activate 订阅生效
+	Activate(sub *Subscription) error
+
+	// Deactivate 订阅暂停/取消/过期, 执行与Activate相反的逻辑, 如关闭自动续费
+	Deactivate(sub *Subscription) error
+}
+
+// planReq 创建计划的请求, paypal.PricingScheme 会序列化零值的create_time/update_time
+type planReq struct {
+	ProductID          string             `json:"product_id"`
+	Name               string             `json:"name"`
+	Description        string             `json:"description,omitempty"`
+	Status             string             `json:"status"`
+	BillingCycles      []billingCycle     `json:"billing_cycles"`
+	PaymentPreferences paymentPreferences `json:"payment_preferences"`
+}
+
+type billingCycle struct {
+	Frequency     paypal.Frequency `json:"frequency"`
+	TenureType    string           `json:"tenure_type"`
+	Sequence      int              `json:"sequence"`
+	TotalCycles   int              `json:"total_cycles"`
+	PricingScheme *pricingScheme   `json:"pricing_scheme,omitempty"`
+}
+
+type pricingScheme struct {
+	FixedPrice *paypal.Money `json:"fixed_price"`
+}
+
+type paymentPreferences struct {
+	AutoBillOutstanding bool `json:"auto_bill_outstanding"`
+}
+
+type pricingSchemeUpdate struct {
+	BillingCycleSequence int            `json:"billing_cycle_sequence"`
+	PricingScheme        *pricingScheme `json:"pricing_scheme"`
+}
+
+// subscriptionResource BILLING.SUBSCRIPTION.* 的resource
+type subscriptionResource struct {
+	ID         string `json:"id"`
+	PlanID     string `json:"plan_id"`
+	Status     string `json:"status"`
+	CustomID   string `json:"custom_id"`
+	StartTime  string `json:"start_time"`
+	Subscriber *struct {
+		PayerID      string `json:"payer_id"`
+		EmailAddress string `json:"email_address"`
+	} `json:"subscriber"`
+	BillingInfo *struct {
+		NextBillingTime string `json:"next_billing_time"`
+	} `json:"billing_info"`
+}
+
+// saleResource PAYMENT.SALE.* 的resource
+type saleResource struct {
+	ID                 string `json:"id"`
+	SaleID             string `json:"sale_id"` // 仅退款时返回
+	State              string `json:"state"`
+	BillingAgreementID string `json:"billing_agreement_id"`
+	Custom             string `json:"custom"`
+	Amount             struct {
+		Total    string `json:"total"`
+		Currency string `json:"currency"`
+	} `json:"amount"`
+}
+
+func (s *saleResource) money() *paypal.Money {
+	return &paypal.Money{
+		Currency: s.Amount.Currency,
+		Value:    s.Amount.Total,
+	}
+}
+
+// CreateProduct 创建订阅的产品
+func (cli *Client) CreateProduct(product paypal.Product) (*paypal.CreateProductResponse, error) {
+	if _, err := cli.GetAccessToken(); err != nil {
+		return nil, err
+	}
+
+	resp, err := cli.client.CreateProduct(context.Background(), product)
+	return resp, respError(err)
+}
+
+// ListProducts 分页查询产品列表, page从1开始
+func (cli *Client) ListProducts(page int) (*paypal.ListProductsResponse, error) {
+	var resp paypal.ListProductsResponse
+	if err := cli.send(http.MethodGet, "/v1/catalogs/products?"+listQuery(page).Encode(), nil, &resp, ""); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// CreatePlan 创建订阅计划, 创建后即为ACTIVE状态
+func (cli *Client) CreatePlan(plan *Plan) (*paypal.SubscriptionPlan, error) {
+	if plan.IntervalCount == 0 {
+		plan.IntervalCount = 1
+	}
+
+	frequency := paypal.Frequency{
+		IntervalUnit:  paypal.IntervalUnit(plan.IntervalUnit),
+		IntervalCount: plan.IntervalCount,
+	}
+
+	req := planReq{
+		ProductID:   plan.ProductID,
+		Name:        plan.Name,
+		Description: plan.Description,
+		Status:      "ACTIVE",
+		PaymentPreferences: paymentPreferences{
+			AutoBillOutstanding: true,
+		},
+	}
+
+	if plan.TrialCycles > 0 {
+		cycle := billingCycle{
+			Frequency:   frequency,
+			TenureType:  "TRIAL",
+			Sequence:    1,
+			TotalCycles: plan.TrialCycles,
+		}
+		// 免费试用不需要pricing_scheme
+		if plan.TrialPrice > 0 {
+			cycle.PricingScheme = newPricingScheme(plan.Currency, plan.TrialPrice)
+		}
+		req.BillingCycles = append(req.BillingCycles, cycle)
+	}
+
+	req.BillingCycles = append(req.BillingCycles, billingCycle{
+		Frequency:     frequency,
+		TenureType:    "REGULAR",
+		Sequence:      len(req.BillingCycles) + 1,
+		TotalCycles:   plan.TotalCycles,
+		PricingScheme: newPricingScheme(plan.Currency, plan.Price),
+	})
+
+	var resp paypal.SubscriptionPlan
+	if err := cli.send(http.MethodPost, "/v1/billing/plans", req, &resp, ""); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// ListPlans 分页查询产品下的订阅计划, productId为空时查询全部计划, page从1开始
+// paypal.Client.ListSubscriptionPlans 会发送空的查询参数
+func (cli *Client) ListPlans(productId string, page int) (*paypal.ListSubscriptionPlansResponse, error) {
+	query := listQuery(page)
+	if productId != "" {
+		query.Set("product_id", productId)
+	}
+
+	var resp paypal.ListSubscriptionPlansResponse
+	if err := cli.send(http.MethodGet, "/v1/billing/plans?"+query.Encode(), nil, &resp, ""); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// UpdatePlanPricing 修改计划的价格, sequence为计划中扣款周期的序号, 有试用期时正式周期为2
+// 已有的订阅在下一次扣款时按新价格扣款
+func (cli *Client) UpdatePlanPricing(planId string, sequence int, currency string, price int) error {
+	req := map[string]interface{}{
+		"pricing_schemes": []pricingSchemeUpdate{
+			{
+				BillingCycleSequence: sequence,
+				PricingScheme:        newPricingScheme(currency, price),
+			},
+		},
+	}
+
+	return cli.send(http.MethodPost, "/v1/billing/plans/"+planId+"/update-pricing-schemes", req, nil, "")
+}
+
+// CreateSubscription 创建订阅, 返回的approve_url由用户打开完成授权
+// PostOrder创建的订单作为首期订单, 商户订单号通过custom_id关联到订阅
+func (cli *Client) CreateSubscription(ctx *unipay.Context, planId string) (unipay.MapResult, error) {
+	if err := cli.RequestSigner.Verify(&ctx.Request); err != nil {
+		return nil, err
+	}
+
+	svc := cli.OrderService
+
+	order, err := svc.PostOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info := order.OrderInfo()
+	req := paypal.SubscriptionBase{
+		PlanID:   planId,
+		CustomID: info.OutTradeNo,
+		ApplicationContext: &paypal.ApplicationContext{
+			ReturnURL:  cli.ReturnURL,
+			CancelURL:  cli.CancelURL,
+			UserAction: "SUBSCRIBE_NOW",
+		},
+	}
+
+	var resp paypal.SubscriptionDetailResp
+	err = cli.send(http.MethodPost, "/v1/billing/subscriptions", req, &resp, "subscription-"+info.OutTradeNo)
+	if err != nil {
+		return nil, err
+	}
+
+	result := unipay.MapResult{
+		"id":           resp.ID,
+		"status":       resp.SubscriptionStatus,
+		"out_trade_no": info.OutTradeNo,
+		"approve_url":  "",
+	}
+
+	for _, e := range resp.Links {
+		if e.Rel == "approve" {
+			result["approve_url"] = e.Href
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// GetSubscription 查询订阅详情
+func (cli *Client) GetSubscription(subscriptionId string) (*paypal.SubscriptionDetailResp, error) {
+	if _, err := cli.GetAccessToken(); err != nil {
+		return nil, err
+	}
+
+	resp, err := cli.client.GetSubscriptionDetails(context.Background(), subscriptionId)
+	return resp, respError(err)
+}
+
+// SuspendSubscription 暂停订阅, 暂停期间不会扣款
+func (cli *Client) SuspendSubscription(subscriptionId, reason string) error {
+	return cli.send(http.MethodPost, "/v1/billing/subscriptions/"+subscriptionId+"/suspend",
+		map[string]string{"reason": reason}, nil, "")
+}
+
+// CancelSubscription 取消订阅, 取消后无法恢复
+func (cli *Client) CancelSubscription(subscriptionId, reason string) error {
+	return cli.send(http.MethodPost, "/v1/billing/subscriptions/"+subscriptionId+"/cancel",
+		map[string]string{"reason": reason}, nil, "")
+}
+
+// ActivateSubscription 恢复已暂停的订阅
+func (cli *Client) ActivateSubscription(subscriptionId, reason string) error {
+	return cli.send(http.MethodPost, "/v1/billing/subscriptions/"+subscriptionId+"/activate",
+		map[string]string{"reason": reason}, nil, "")
+}
+
+// subscriptionChanged 处理订阅状态变更通知
+func (cli *Client) subscriptionChanged(eventType string, resource *subscriptionResource) error {
+	svc := cli.SubscriptionService
+	if svc == nil {
+		svc, _ = cli.OrderService.(SubscriptionService)
+	}
+	if svc == nil {
+		return nil
+	}
+
+	sub := &Subscription{
+		ID:         resource.ID,
+		PlanID:     resource.PlanID,
+		Status:     resource.Status,
+		OutTradeNo: resource.CustomID,
+		StartTime:  resource.StartTime,
+	}
+	if s := resource.Subscriber; s != nil {
+		sub.PayerID = s.PayerID
+		sub.Email = s.EmailAddress
+	}
+	if b := resource.BillingInfo; b != nil {
+		sub.NextBillingTime = b.NextBillingTime
+	}
+
+	switch eventType {
+	case EventBillingSubscriptionActivated:
+		return svc.Activate(sub)
+	case EventBillingSubscriptionSuspended, EventBillingSubscriptionCancelled, EventBillingSubscriptionExpired:
+		return svc.Deactivate(sub)
+	}
+
+	return nil
+}
+
+// saleCompleted 处理订阅扣款, 首期扣款处理创建订阅时的订单, 续费时与IAP续费一样通过PostOrder创建订单
+func (cli *Client) saleCompleted(resource *saleResource) error {
+	if resource.BillingAgreementID == "" {
+		// 非订阅的扣款
+		return nil
+	}
+
+	totalFee, err := parseAmount(resource.money())
+	if err != nil {
+		return err
+	}
+
+	sale := &SubscriptionSale{
+		ID:             resource.ID,
+		SubscriptionID: resource.BillingAgreementID,
+		OutTradeNo:     resource.Custom,
+		TotalFee:       totalFee,
+		Currency:       resource.Amount.Currency,
+	}
+
+	// 与Invoke使用相同的锁, custom_id为首期订单的out_trade_no, 同一订阅的扣款串行处理, 避免重复创建续费订单
+	key := sale.OutTradeNo
+	if key == "" {
+		key = sale.SubscriptionID
+	}
+	unlock, err := unipay.AcquireLock(cli.Locker, key, cli.LockOptions)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	svc := cli.OrderService
+	order, err := svc.GetOrderByTradeNo(sale.ID, unipay.PayWay_Paypal)
+	if unipay.IsOrderNotFoundError(err) {
+		order, err = cli.saleOrder(sale)
+	}
+	if err != nil {
+		// 查询失败时返回错误由paypal重试, 不能当作订单不存在创建续费订单
+		return err
+	}
+
+	// 续费订单的退款按续费订单的out_trade_no加锁
+	if outTradeNo := order.OrderInfo().OutTradeNo; outTradeNo != key {
+		unlockOrder, err := unipay.AcquireLock(cli.Locker, outTradeNo, cli.LockOptions)
+		if err != nil {
+			return err
+		}
+		defer unlockOrder()
+	}
+
+	if err := unipay.CheckTransition(order, unipay.OrderEventPay); err != nil {
+		// 订单已处理，直接返回
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := checkAmount(order.OrderInfo(), resource.money()); err != nil {
+		return err
+	}
+
+	return svc.Invoke(order)
+}
+
+// saleOrder 扣款对应的订单, 首期订单未支付时返回首期订单, 否则为续费创建新订单
+func (cli *Client) saleOrder(sale *SubscriptionSale) (unipay.IOrder, error) {
+	svc := cli.OrderService
+
+	if sale.OutTradeNo != "" {
+		order, err := svc.GetOrderByTradeNo(sale.OutTradeNo, unipay.PayWay_Paypal)
+		if err != nil && !unipay.IsOrderNotFoundError(err) {
+			return nil, err
+		}
+		if err == nil && unipay.CheckTransition(order, unipay.OrderEventPay) == nil {
+			order.OrderInfo().TradeNo = sale.ID
+			return order, nil
+		}
+	}
+
+	ctx := &unipay.Context{}
+	ctx.InApp = sale
+	ctx.Currency = sale.Currency
+	ctx.TransactionId = sale.ID
+	ctx.OriginalTransactionID = sale.SubscriptionID
+
+	if iap, ok := svc.(unipay.IapOrderService); ok {
+		if err := iap.CheckSubUser(ctx, sale.SubscriptionID, sale.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return svc.PostOrder(ctx)
+}
+
+// saleRefunded 处理订阅扣款的退款和撤销, 撤销视为全额退款
+func (cli *Client) saleRefunded(resource *saleResource, reversed bool) error {
+	saleId := resource.SaleID
+	if reversed {
+		saleId = resource.ID
+	}
+
+	if saleId == "" {
+		return errors.New("unipaypal: sale id required")
+	}
+
+	svc := cli.OrderService
+	order, err := svc.GetOrderByTradeNo(saleId, unipay.PayWay_Paypal)
+	if err != nil {
+		return err
+	}
+
+	// 与Invoke/Refund使用相同的锁, 加锁后重新查询订单状态
+	outTradeNo := order.OrderInfo().OutTradeNo
+	unlock, err := unipay.AcquireLock(cli.Locker, outTradeNo, cli.LockOptions)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	order, err = svc.GetOrderByTradeNo(outTradeNo, unipay.PayWay_Paypal)
+	if err != nil {
+		return err
+	}
+
+	event := unipay.OrderEventRefund
+	refundFee := 0
+	if !reversed {
+		refundFee, err = parseAmount(resource.money())
+		if err != nil {
+			return err
+		}
+
+		if refundFee < order.OrderInfo().TotalFee {
+			event = unipay.OrderEventPartialRefund
+		}
+	}
+
+	if err := unipay.CheckTransition(order, event); err != nil {
+		// 订单已退款，直接返回; 未支付的订单不能退款
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	if event == unipay.OrderEventRefund {
+		return svc.Revoke(order)
+	}
+
+	if partial, ok := svc.(unipay.PartialRefundService); ok {
+		return partial.PartialRefund(order, resource.ID, refundFee)
+	}
+
+	return nil
+}
+
+func newPricingScheme(currency string, price int) *pricingScheme {
+	return &pricingScheme{
+		FixedPrice: toMoney(unipay.NewMoney(int64(price), currency)),
+	}
+}
+
+// listQuery 分页查询参数, 每页返回paypal允许的最大条数
+func listQuery(page int) url.Values {
+	if page < 1 {
+		page = 1
+	}
+
+	query := url.Values{}
+	query.Set("page", strconv.Itoa(page))
+	query.Set("page_size", "20")
+	query.Set("total_required", "true")
+	return query
+}
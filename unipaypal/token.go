@@ -0,0 +1,104 @@
+package unipaypal
+
+import (
+	"context"
+	"time"
+
+	paypal "github.com/plutov/paypal/v4"
+)
+
+// tokenRefreshBefore access token到期前提前刷新的时间
+const tokenRefreshBefore = 5 * time.Minute
+
+// Token paypal的access token
+type Token struct {
+	AccessToken string
+	ExpiresAt   time.Time
+}
+
+func (t *Token) valid() bool {
+	return t != nil && t.AccessToken != "" && time.Until(t.ExpiresAt) > tokenRefreshBefore
+}
+
+// TokenStore 共享access token, 多个服务实例共用同一个token, 避免各自频繁请求/v1/oauth2/token
+// key为clientId, token不存在时返回nil, nil
+type TokenStore interface {
+	Load(key string) (*Token, error)
+	Save(key string, token *Token) error
+}
+
+// GetAccessToken 获取access token, 即将过期时自动刷新
+// 并发调用时只有一个调用者请求paypal, 其他调用者等待并使用刷新后的token
+func (cli *Client) GetAccessToken() (*paypal.TokenResponse, error) {
+	token, err := cli.accessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return &paypal.TokenResponse{
+		Token: token.AccessToken,
+		Type:  "Bearer",
+	}, nil
+}
+
+func (cli *Client) accessToken() (*Token, error) {
+	cli.tokenMu.RLock()
+	token := cli.token
+	cli.tokenMu.RUnlock()
+
+	if token.valid() {
+		return token, nil
+	}
+
+	cli.refreshMu.Lock()
+	defer cli.refreshMu.Unlock()
+
+	// 等待期间其他调用者可能已经完成刷新
+	cli.tokenMu.RLock()
+	token = cli.token
+	cli.tokenMu.RUnlock()
+
+	if token.valid() {
+		return token, nil
+	}
+
+	if cli.TokenStore != nil {
+		if token, err := cli.TokenStore.Load(cli.clientId); err == nil && token.valid() {
+			cli.setToken(token)
+			return token, nil
+		}
+	}
+
+	c := cli.client
+	c.Lock()
+	resp, err := c.GetAccessToken(context.Background())
+	c.Unlock()
+	if err != nil {
+		return nil, respError(err)
+	}
+
+	token = &Token{
+		AccessToken: resp.Token,
+		ExpiresAt:   time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}
+	cli.setToken(token)
+
+	if cli.TokenStore != nil {
+		// 共享失败不影响当前实例使用
+		cli.TokenStore.Save(cli.clientId, token)
+	}
+
+	return token, nil
+}
+
+// setToken 更新token, paypal.Client中的过期时间置零, 刷新统一由accessToken完成
+func (cli *Client) setToken(token *Token) {
+	cli.tokenMu.Lock()
+	cli.token = token
+	cli.tokenMu.Unlock()
+
+	c := cli.client
+	c.Lock()
+	c.SetAccessToken(token.AccessToken)
+	c.Unlock()
+}
@@ -0,0 +1,381 @@
+package unipaypal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lovewith99/unipay"
+	paypal "github.com/plutov/paypal/v4"
+)
+
+// webhook事件类型
+const (
+	EventCheckoutOrderApproved  = "CHECKOUT.ORDER.APPROVED"
+	EventPaymentCaptureComplete = "PAYMENT.CAPTURE.COMPLETED"
+	EventPaymentCaptureRefunded = "PAYMENT.CAPTURE.REFUNDED"
+	EventPaymentCaptureReversed = "PAYMENT.CAPTURE.REVERSED"
+
+	EventBillingSubscriptionActivated = "BILLING.SUBSCRIPTION.ACTIVATED"
+	EventBillingSubscriptionSuspended = "BILLING.SUBSCRIPTION.SUSPENDED"
+	EventBillingSubscriptionCancelled = "BILLING.SUBSCRIPTION.CANCELLED"
+	EventBillingSubscriptionExpired   = "BILLING.SUBSCRIPTION.EXPIRED"
+	EventPaymentSaleCompleted         = "PAYMENT.SALE.COMPLETED"
+	EventPaymentSaleRefunded          = "PAYMENT.SALE.REFUNDED"
+	EventPaymentSaleReversed          = "PAYMENT.SALE.REVERSED"
+)
+
+// CertFetcher 根据PAYPAL-CERT-URL获取webhook签名证书, 离线验签时使用
+// 可注入自定义实现, 用于缓存证书或在测试中使用本地证书
+type CertFetcher interface {
+	Fetch(certURL string) (*x509.Certificate, error)
+}
+
+// webhookEvent webhook事件, resource根据事件类型解析
+type webhookEvent struct {
+	ID           string          `json:"id"`
+	EventType    string          `json:"event_type"`
+	ResourceType string          `json:"resource_type"`
+	Resource     json.RawMessage `json:"resource"`
+}
+
+// refundResource PAYMENT.CAPTURE.REFUNDED / PAYMENT.CAPTURE.REVERSED 的resource
+type refundResource struct {
+	ID                     string        `json:"id"`
+	Status                 string        `json:"status"`
+	InvoiceID              string        `json:"invoice_id"`
+	Amount                 *paypal.Money `json:"amount"`
+	SellerPayableBreakdown *struct {
+		TotalRefundedAmount *paypal.Money `json:"total_refunded_amount"`
+	} `json:"seller_payable_breakdown"`
+	Links []paypal.Link `json:"links"`
+}
+
+// captureID 退款对应的扣款id, 取自rel为up的链接
+func (resource *refundResource) captureID() string {
+	for _, e := range resource.Links {
+		if e.Rel == "up" {
+			if i := strings.LastIndex(e.Href, "/captures/"); i >= 0 {
+				return e.Href[i+len("/captures/"):]
+			}
+		}
+	}
+	return ""
+}
+
+// orderResource CHECKOUT.ORDER.APPROVED 的resource
+type orderResource struct {
+	ID     string `json:"id"`
+	Intent string `json:"intent"`
+	Status string `json:"status"`
+}
+
+// Webhook 验证并处理paypal webhook事件, 返回nil时应答2xx, 否则paypal会重复投递
+// PAYMENT.CAPTURE.COMPLETED 执行OrderService.Invoke
+// PAYMENT.CAPTURE.REFUNDED 全额退款执行OrderService.Revoke, 部分退款调用unipay.PartialRefundService
+// PAYMENT.CAPTURE.REVERSED 执行OrderService.Revoke
+// CHECKOUT.ORDER.APPROVED 用户同意支付但未跳转回ReturnURL时, 由服务端完成Capture或Authorize
+// PAYMENT.SALE.COMPLETED 订阅扣款, 首期订单或续费订单执行OrderService.Invoke
+// PAYMENT.SALE.REFUNDED / PAYMENT.SALE.REVERSED 订阅扣款的退款和撤销, 与PAYMENT.CAPTURE.*一致
+// BILLING.SUBSCRIPTION.* 订阅状态变更, 调用SubscriptionService
+func (cli *Client) Webhook(req *http.Request) error {
+	defer req.Body.Close()
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := cli.VerifyWebhook(req.Header, body); err != nil {
+		return err
+	}
+
+	var event webhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return err
+	}
+
+	// paypal至少投递一次, 同一事件可能重复通知, 以事件ID去重
+	return unipay.ProcessNotification(cli.NotificationStore, &unipay.Notification{
+		PayWay:  unipay.PayWay_Paypal,
+		ID:      event.ID,
+		Type:    event.EventType,
+		Header:  req.Header,
+		Payload: body,
+	}, func() error {
+		return cli.handleEvent(&event)
+	})
+}
+
+// WebhookHandler paypal webhook的http.Handler
+func (cli *Client) WebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := cli.Webhook(req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func (cli *Client) handleEvent(event *webhookEvent) error {
+	switch event.EventType {
+	case EventPaymentCaptureComplete:
+		var resource capture
+		if err := json.Unmarshal(event.Resource, &resource); err != nil {
+			return err
+		}
+		return cli.captureCompleted(&resource)
+	case EventPaymentCaptureRefunded, EventPaymentCaptureReversed:
+		var resource refundResource
+		if err := json.Unmarshal(event.Resource, &resource); err != nil {
+			return err
+		}
+		return cli.refunded(&resource, event.EventType == EventPaymentCaptureReversed)
+	case EventCheckoutOrderApproved:
+		var resource orderResource
+		if err := json.Unmarshal(event.Resource, &resource); err != nil {
+			return err
+		}
+		var err error
+		switch resource.Intent {
+		case IntentCapture:
+			_, err = cli.Capture(resource.ID)
+		case IntentAuthorize:
+			_, err = cli.Authorize(resource.ID)
+		}
+		return err
+	case EventPaymentSaleCompleted:
+		var resource saleResource
+		if err := json.Unmarshal(event.Resource, &resource); err != nil {
+			return err
+		}
+		return cli.saleCompleted(&resource)
+	case EventPaymentSaleRefunded, EventPaymentSaleReversed:
+		var resource saleResource
+		if err := json.Unmarshal(event.Resource, &resource); err != nil {
+			return err
+		}
+		return cli.saleRefunded(&resource, event.EventType == EventPaymentSaleReversed)
+	case EventBillingSubscriptionActivated, EventBillingSubscriptionSuspended,
+		EventBillingSubscriptionCancelled, EventBillingSubscriptionExpired:
+		var resource subscriptionResource
+		if err := json.Unmarshal(event.Resource, &resource); err != nil {
+			return err
+		}
+		return cli.subscriptionChanged(event.EventType, &resource)
+	}
+
+	return nil
+}
+
+func (cli *Client) captureCompleted(cp *capture) error {
+	order, err := cli.OrderService.GetOrderByTradeNo(cp.InvoiceID, unipay.PayWay_Paypal)
+	if err != nil {
+		return err
+	}
+
+	if err := checkAmount(order.OrderInfo(), cp.Amount); err != nil {
+		return err
+	}
+
+	return cli.Invoke(cp.InvoiceID)
+}
+
+// parseAmount 将paypal金额转换为以最小单位计的整数
+func parseAmount(amount *paypal.Money) (int, error) {
+	if amount == nil {
+		return 0, fmt.Errorf("%w: amount missing", unipay.ErrAmountMismatch)
+	}
+
+	m, err := unipay.ParseMoney(amount.Value, amount.Currency)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(m.Amount), nil
+}
+
+// VerifyWebhook 验证webhook的签名
+// 配置了CertFetcher时离线验签, 否则调用paypal的verify-webhook-signature接口
+func (cli *Client) VerifyWebhook(header http.Header, body []byte) error {
+	if cli.WebhookID == "" {
+		return errors.New("unipaypal: webhook id not configured")
+	}
+
+	if cli.CertFetcher != nil {
+		return cli.verifyWebhookOffline(header, body)
+	}
+
+	if _, err := cli.GetAccessToken(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+
+	resp, err := cli.client.VerifyWebhookSignature(context.Background(), req, cli.WebhookID)
+	if err != nil {
+		return respError(err)
+	}
+
+	if resp.VerificationStatus != "SUCCESS" {
+		return fmt.Errorf("%w: paypal webhook", unipay.ErrSignatureInvalid)
+	}
+
+	return nil
+}
+
+// verifyWebhookOffline 离线验签
+// 签名原文: transmission_id|transmission_time|webhook_id|crc32(body)
+// https://developer.paypal.com/api/rest/webhooks/rest/#link-selfverificationmethod
+func (cli *Client) verifyWebhookOffline(header http.Header, body []byte) error {
+	if algo := header.Get("PAYPAL-AUTH-ALGO"); algo != "SHA256withRSA" {
+		return fmt.Errorf("unipaypal: unsupported auth algo: %s", algo)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(header.Get("PAYPAL-TRANSMISSION-SIG"))
+	if err != nil {
+		return err
+	}
+
+	cert, err := cli.CertFetcher.Fetch(header.Get("PAYPAL-CERT-URL"))
+	if err != nil {
+		return err
+	}
+
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("unipaypal: webhook cert is not rsa")
+	}
+
+	message := strings.Join([]string{
+		header.Get("PAYPAL-TRANSMISSION-ID"),
+		header.Get("PAYPAL-TRANSMISSION-TIME"),
+		cli.WebhookID,
+		strconv.FormatUint(uint64(crc32.ChecksumIEEE(body)), 10),
+	}, "|")
+
+	h := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig); err != nil {
+		return fmt.Errorf("%w: paypal webhook", unipay.ErrSignatureInvalid)
+	}
+
+	return nil
+}
+
+// httpCertFetcher 通过https下载证书并缓存, 只允许paypal.com域名下的证书地址
+type httpCertFetcher struct {
+	client *http.Client
+
+	mu    sync.RWMutex
+	certs map[string]*x509.Certificate
+}
+
+// NewCertFetcher 创建默认的CertFetcher, client为nil时使用http.DefaultClient
+func NewCertFetcher(client *http.Client) CertFetcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &httpCertFetcher{
+		client: client,
+		certs:  make(map[string]*x509.Certificate),
+	}
+}
+
+func (f *httpCertFetcher) Fetch(certURL string) (*x509.Certificate, error) {
+	f.mu.RLock()
+	cert, ok := f.certs[certURL]
+	f.mu.RUnlock()
+	if ok && time.Now().Before(cert.NotAfter) {
+		return cert, nil
+	}
+
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), ".paypal.com") {
+		return nil, fmt.Errorf("unipaypal: untrusted cert url: %s", certURL)
+	}
+
+	resp, err := f.client.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unipaypal: fetch cert: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err = verifyCertChain(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.certs[certURL] = cert
+	f.mu.Unlock()
+
+	return cert, nil
+}
+
+// verifyCertChain 解析PEM证书链, 使用系统根证书验证第一个证书
+func verifyCertChain(data []byte) (*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("unipaypal: no certificate found")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	if _, err := certs[0].Verify(x509.VerifyOptions{Intermediates: intermediates}); err != nil {
+		return nil, err
+	}
+
+	return certs[0], nil
+}
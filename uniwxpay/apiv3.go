@@ -0,0 +1,485 @@
+package uniwxpay
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lovewith99/unipay"
+)
+
+const (
+	// certsRefreshInterval 平台证书的刷新间隔, 微信支付建议定期下载以支持证书轮换
+	certsRefreshInterval = 12 * time.Hour
+
+	// certsMinRefreshInterval 两次下载平台证书的最小间隔
+	// 通知中的Wechatpay-Serial不可信, 未知序列号不能导致每个请求都下载证书
+	certsMinRefreshInterval = time.Minute
+
+	// certsNotFoundTTL 下载后仍不存在的序列号的缓存时间, 期间直接返回证书不存在
+	certsNotFoundTTL = 10 * time.Minute
+
+	// certsNotFoundMax 缓存的不存在序列号的最大数量, 超过时清空
+	certsNotFoundMax = 1024
+
+	// signatureMaxSkew 应答和通知签名时间戳允许的最大偏差
+	signatureMaxSkew = 5 * time.Minute
+)
+
+// APIv3Error 微信支付APIv3接口返回的错误
+type APIv3Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *APIv3Error) Error() string {
+	return fmt.Sprintf("wxpay v3: %d %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Unwrap 转换为unipay.ProviderError, 5xx和频率限制为可重试的错误
+func (e *APIv3Error) Unwrap() error {
+	return &unipay.ProviderError{
+		PayWay:    unipay.PayWay_WxPay,
+		Code:      e.Code,
+		Message:   e.Message,
+		Retryable: e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests,
+	}
+}
+
+// EncryptedResource APIv3中使用AEAD_AES_256_GCM加密的数据
+type EncryptedResource struct {
+	Algorithm      string `json:"algorithm"`
+	Ciphertext     string `json:"ciphertext"`
+	AssociatedData string `json:"associated_data"`
+	OriginalType   string `json:"original_type"`
+	Nonce          string `json:"nonce"`
+}
+
+// apiV3 微信支付APIv3的请求签名, 应答验签, 平台证书管理
+type apiV3 struct {
+	mchId      string
+	serialNo   string // 商户证书序列号
+	privateKey *rsa.PrivateKey
+	apiV3Key   []byte
+	domain     string
+	client     *http.Client
+
+	mu            sync.RWMutex
+	certs         map[string]*x509.Certificate // 平台证书, 证书序列号 -> 证书
+	certsUpdateAt time.Time
+	notFound      map[string]time.Time // 下载后仍不存在的序列号 -> 过期时间
+
+	refreshMu  sync.Mutex // 同一时间只下载一次平台证书, 并发请求共享下载结果
+	refreshAt  time.Time
+	refreshErr error
+}
+
+func newAPIv3(mchId, serialNo string, privateKeyPem []byte, apiV3Key string, client *http.Client) (*apiV3, error) {
+	if len(apiV3Key) != 32 {
+		return nil, errors.New("uniwxpay: apiv3 key must be 32 bytes")
+	}
+
+	key, err := parsePrivateKey(privateKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiV3{
+		mchId:      mchId,
+		serialNo:   serialNo,
+		privateKey: key,
+		apiV3Key:   []byte(apiV3Key),
+		domain:     defaultDomain,
+		client:     client,
+		certs:      make(map[string]*x509.Certificate),
+		notFound:   make(map[string]time.Time),
+	}, nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("uniwxpay: merchant private key: no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("uniwxpay: merchant private key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("uniwxpay: merchant private key is not RSA")
+	}
+	return rsaKey, nil
+}
+
+func nonceStr() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sign 使用商户私钥进行SHA256-RSA签名
+func (v3 *apiV3) sign(message string) (string, error) {
+	h := sha256.Sum256([]byte(message))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, v3.privateKey, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// signLines 按照APIv3签名串的规则, 每行以\n结尾
+func (v3 *apiV3) signLines(lines ...string) (string, error) {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return v3.sign(buf.String())
+}
+
+func (v3 *apiV3) authorization(method, path string, body []byte) (string, error) {
+	nonce := nonceStr()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	signature, err := v3.signLines(method, path, timestamp, nonce, string(body))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`WECHATPAY2-SHA256-RSA2048 mchid="%s",nonce_str="%s",signature="%s",timestamp="%s",serial_no="%s"`,
+		v3.mchId, nonce, signature, timestamp, v3.serialNo), nil
+}
+
+// Do 发起APIv3请求, result为nil时忽略应答内容
+func (v3 *apiV3) Do(method, path string, body, result interface{}) error {
+	data, err := v3.do(method, path, body)
+	if err != nil {
+		return err
+	}
+
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (v3 *apiV3) do(method, path string, body interface{}) ([]byte, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	auth, err := v3.authorization(method, path, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, v3.domain+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &APIv3Error{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, apiErr)
+		return nil, apiErr
+	}
+
+	// 204 No Content 的应答没有需要验签的内容
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	if err := v3.VerifyHeader(resp.Header, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// VerifyHeader 使用平台证书验证应答或通知的签名
+func (v3 *apiV3) VerifyHeader(header http.Header, body []byte) error {
+	serial := header.Get("Wechatpay-Serial")
+	signature := header.Get("Wechatpay-Signature")
+	timestamp := header.Get("Wechatpay-Timestamp")
+	nonce := header.Get("Wechatpay-Nonce")
+
+	if signature == "" {
+		return fmt.Errorf("%w: missing Wechatpay-Signature", unipay.ErrSignatureInvalid)
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid Wechatpay-Timestamp", unipay.ErrSignatureInvalid)
+	}
+
+	if d := time.Since(time.Unix(ts, 0)); d > signatureMaxSkew || d < -signatureMaxSkew {
+		return fmt.Errorf("%w: Wechatpay-Timestamp expired", unipay.ErrSignatureInvalid)
+	}
+
+	cert, err := v3.certificate(serial)
+	if err != nil {
+		return err
+	}
+
+	return verifySignature(cert, timestamp+"\n"+nonce+"\n"+string(body)+"\n", signature)
+}
+
+func verifySignature(cert *x509.Certificate, message, signature string) error {
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("uniwxpay: platform certificate is not RSA")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: wxpay", unipay.ErrSignatureInvalid)
+	}
+
+	h := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig); err != nil {
+		return fmt.Errorf("%w: wxpay", unipay.ErrSignatureInvalid)
+	}
+	return nil
+}
+
+// certificate 根据序列号获取平台证书, 证书过期或序列号未知时重新下载
+// 下载受certsMinRefreshInterval限制, 下载后仍不存在的序列号在certsNotFoundTTL内不再触发下载
+func (v3 *apiV3) certificate(serial string) (*x509.Certificate, error) {
+	v3.mu.RLock()
+	cert := v3.certs[serial]
+	fresh := time.Since(v3.certsUpdateAt) < certsRefreshInterval
+	notFound := time.Now().Before(v3.notFound[serial])
+	v3.mu.RUnlock()
+
+	if cert != nil && fresh {
+		return cert, nil
+	}
+	if notFound {
+		return nil, fmt.Errorf("%w: platform certificate not found: %s", unipay.ErrSignatureInvalid, serial)
+	}
+
+	if err := v3.refreshCertificates(); err != nil {
+		if cert != nil {
+			// 下载失败时继续使用缓存的证书
+			return cert, nil
+		}
+		return nil, err
+	}
+
+	v3.mu.Lock()
+	defer v3.mu.Unlock()
+
+	if cert = v3.certs[serial]; cert != nil {
+		return cert, nil
+	}
+
+	if len(v3.notFound) >= certsNotFoundMax {
+		v3.notFound = make(map[string]time.Time)
+	}
+	v3.notFound[serial] = time.Now().Add(certsNotFoundTTL)
+	return nil, fmt.Errorf("%w: platform certificate not found: %s", unipay.ErrSignatureInvalid, serial)
+}
+
+// refreshCertificates 下载平台证书, 并发调用时只有一个请求下载, 其他请求等待并共享结果
+// 距上次下载不足certsMinRefreshInterval时直接返回上次的结果
+func (v3 *apiV3) refreshCertificates() error {
+	v3.refreshMu.Lock()
+	defer v3.refreshMu.Unlock()
+
+	if time.Since(v3.refreshAt) < certsMinRefreshInterval {
+		return v3.refreshErr
+	}
+
+	v3.refreshErr = v3.DownloadCertificates()
+	v3.refreshAt = time.Now()
+	return v3.refreshErr
+}
+
+// DownloadCertificates 下载并缓存平台证书
+// https://pay.weixin.qq.com/wiki/doc/apiv3/apis/wechatpay5_1.shtml
+func (v3 *apiV3) DownloadCertificates() error {
+	const path = "/v3/certificates"
+
+	auth, err := v3.authorization(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, v3.domain+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v3.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &APIv3Error{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, apiErr)
+		return apiErr
+	}
+
+	var body struct {
+		Data []struct {
+			SerialNo           string            `json:"serial_no"`
+			EncryptCertificate EncryptedResource `json:"encrypt_certificate"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return err
+	}
+
+	certs := make(map[string]*x509.Certificate)
+	for _, e := range body.Data {
+		plain, err := v3.Decrypt(&e.EncryptCertificate)
+		if err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode(plain)
+		if block == nil {
+			return errors.New("uniwxpay: invalid platform certificate")
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		certs[e.SerialNo] = cert
+	}
+
+	// 应答本身的签名使用刚下载的证书验证
+	serial := resp.Header.Get("Wechatpay-Serial")
+	cert := certs[serial]
+	if cert == nil {
+		return errors.New("uniwxpay: platform certificate not found: " + serial)
+	}
+
+	message := resp.Header.Get("Wechatpay-Timestamp") + "\n" + resp.Header.Get("Wechatpay-Nonce") + "\n" + string(data) + "\n"
+	if err := verifySignature(cert, message, resp.Header.Get("Wechatpay-Signature")); err != nil {
+		return err
+	}
+
+	v3.mu.Lock()
+	v3.certs = certs
+	v3.certsUpdateAt = time.Now()
+	v3.notFound = make(map[string]time.Time)
+	v3.mu.Unlock()
+	return nil
+}
+
+// Decrypt 使用APIv3密钥解密AEAD_AES_256_GCM加密的数据
+func (v3 *apiV3) Decrypt(res *EncryptedResource) ([]byte, error) {
+	if res.Algorithm != "AEAD_AES_256_GCM" {
+		return nil, errors.New("uniwxpay: unsupported algorithm: " + res.Algorithm)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(res.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(v3.apiV3Key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(res.Nonce))
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, []byte(res.Nonce), ciphertext, []byte(res.AssociatedData))
+}
+
+// ParseNotification 验证通知签名并解密通知中的resource
+func (v3 *apiV3) ParseNotification(req *http.Request, result interface{}) (*NotificationV3, error) {
+	defer req.Body.Close()
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := v3.VerifyHeader(req.Header, body); err != nil {
+		return nil, err
+	}
+
+	var noti NotificationV3
+	if err := json.Unmarshal(body, &noti); err != nil {
+		return nil, err
+	}
+
+	plain, err := v3.Decrypt(&noti.Resource)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(plain, result); err != nil {
+		return nil, err
+	}
+
+	return &noti, nil
+}
+
+// NotificationV3 APIv3的通知报文
+type NotificationV3 struct {
+	Id           string            `json:"id"`
+	CreateTime   string            `json:"create_time"`
+	EventType    string            `json:"event_type"`
+	ResourceType string            `json:"resource_type"`
+	Summary      string            `json:"summary"`
+	Resource     EncryptedResource `json:"resource"`
+}
@@ -0,0 +1,324 @@
+package uniwxpay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lovewith99/unipay"
+)
+
+type amountV3 struct {
+	Total      int    `json:"total,omitempty"`
+	PayerTotal int    `json:"payer_total,omitempty"`
+	Refund     int    `json:"refund,omitempty"`
+	Currency   string `json:"currency,omitempty"`
+}
+
+type payerV3 struct {
+	OpenId string `json:"openid"`
+}
+
+type sceneInfoV3 struct {
+	PayerClientIp string    `json:"payer_client_ip"`
+	H5Info        *h5InfoV3 `json:"h5_info,omitempty"`
+}
+
+// h5InfoV3 APIv3的H5场景信息, WAP网站的URL和名称使用app_url和app_name
+type h5InfoV3 struct {
+	Type        string `json:"type"`
+	AppName     string `json:"app_name,omitempty"`
+	AppUrl      string `json:"app_url,omitempty"`
+	BundleId    string `json:"bundle_id,omitempty"`
+	PackageName string `json:"package_name,omitempty"`
+}
+
+func newH5InfoV3(scene *H5SceneInfo) *h5InfoV3 {
+	info := &h5InfoV3{
+		Type:        scene.Type,
+		AppName:     scene.AppName,
+		AppUrl:      scene.WapURL,
+		BundleId:    scene.BundleId,
+		PackageName: scene.PackageName,
+	}
+	if info.AppName == "" {
+		info.AppName = scene.WapName
+	}
+	return info
+}
+
+// orderV3 APIv3下单参数 https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_2_1.shtml
+type orderV3 struct {
+	AppId       string       `json:"appid"`
+	MchId       string       `json:"mchid"`
+	Description string       `json:"description"`
+	OutTradeNo  string       `json:"out_trade_no"`
+	TimeExpire  string       `json:"time_expire,omitempty"`
+	Attach      string       `json:"attach,omitempty"`
+	NotifyURL   string       `json:"notify_url"`
+	Amount      amountV3     `json:"amount"`
+	Payer       *payerV3     `json:"payer,omitempty"`
+	SceneInfo   *sceneInfoV3 `json:"scene_info,omitempty"`
+}
+
+type orderV3Resp struct {
+	PrepayId string `json:"prepay_id"`
+	CodeUrl  string `json:"code_url"`
+	H5Url    string `json:"h5_url"`
+}
+
+// transactionV3 APIv3的订单信息, 用于订单查询和支付通知
+type transactionV3 struct {
+	AppId          string   `json:"appid"`
+	MchId          string   `json:"mchid"`
+	OutTradeNo     string   `json:"out_trade_no"`
+	TransactionId  string   `json:"transaction_id"`
+	TradeType      string   `json:"trade_type"`
+	TradeState     string   `json:"trade_state"`
+	TradeStateDesc string   `json:"trade_state_desc"`
+	Attach         string   `json:"attach"`
+	SuccessTime    string   `json:"success_time"`
+	Amount         amountV3 `json:"amount"`
+	Payer          payerV3  `json:"payer"`
+}
+
+func (t *transactionV3) trade() *Trade {
+	return &Trade{
+		OutTradeNo:     t.OutTradeNo,
+		TransactionId:  t.TransactionId,
+		TradeType:      t.TradeType,
+		TradeState:     t.TradeState,
+		TradeStateDesc: t.TradeStateDesc,
+		TotalFee:       t.Amount.Total,
+		FeeType:        t.Amount.Currency,
+		Attach:         t.Attach,
+		OpenId:         t.Payer.OpenId,
+		TimeEnd:        t.SuccessTime,
+	}
+}
+
+type refundV3 struct {
+	OutTradeNo  string   `json:"out_trade_no"`
+	OutRefundNo string   `json:"out_refund_no"`
+	Reason      string   `json:"reason,omitempty"`
+	NotifyURL   string   `json:"notify_url,omitempty"`
+	Amount      amountV3 `json:"amount"`
+}
+
+type refundV3Resp struct {
+	RefundId      string   `json:"refund_id"`
+	OutRefundNo   string   `json:"out_refund_no"`
+	TransactionId string   `json:"transaction_id"`
+	OutTradeNo    string   `json:"out_trade_no"`
+	Status        string   `json:"status"`
+	Amount        amountV3 `json:"amount"`
+}
+
+// refundNotifyV3 APIv3退款结果通知的资源数据
+type refundNotifyV3 struct {
+	MchId         string   `json:"mchid"`
+	OutTradeNo    string   `json:"out_trade_no"`
+	TransactionId string   `json:"transaction_id"`
+	OutRefundNo   string   `json:"out_refund_no"`
+	RefundId      string   `json:"refund_id"`
+	RefundStatus  string   `json:"refund_status"`
+	Amount        amountV3 `json:"amount"`
+}
+
+func (r *refundV3Resp) refund() *Refund {
+	return &Refund{
+		OutTradeNo:    r.OutTradeNo,
+		TransactionId: r.TransactionId,
+		OutRefundNo:   r.OutRefundNo,
+		RefundId:      r.RefundId,
+		TotalFee:      r.Amount.Total,
+		RefundFee:     r.Amount.Refund,
+		Status:        r.Status,
+	}
+}
+
+// orderV3 创建订单并调用APIv3下单接口, tradeType: app | jsapi | native | h5
+func (cli *Client) orderV3(ctx *unipay.Context, tradeType string, obj *orderV3) (*orderV3Resp, error) {
+	order, err := cli.postOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info := order.OrderInfo()
+	obj.AppId = cli.appId
+	obj.MchId = cli.mchId
+	obj.Description = info.Subject
+	obj.OutTradeNo = info.OutTradeNo
+	obj.Attach = info.Attach
+	obj.NotifyURL = cli.NotifyURL
+	obj.Amount = amountV3{Total: info.TotalFee, Currency: orderAmount(info).Currency}
+
+	if info.Timeout > 0 {
+		obj.TimeExpire = time.Now().Add(info.Timeout).In(timeLocation).Format(time.RFC3339)
+	}
+
+	var resp orderV3Resp
+	if err := cli.v3.Do(http.MethodPost, "/v3/pay/transactions/"+tradeType, obj, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// appRequestDataV3 APP调起支付的参数 https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_2_4.shtml
+func (cli *Client) appRequestDataV3(prepayId string) (unipay.MapResult, error) {
+	nonce := nonceStr()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	sign, err := cli.v3.signLines(cli.appId, timestamp, nonce, prepayId)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"appId":        cli.appId,
+		"partnerId":    cli.mchId,
+		"prepayId":     prepayId,
+		"packageValue": "Sign=WXPay",
+		"nonceStr":     nonce,
+		"timeStamp":    timestamp,
+		"sign":         sign,
+	}, nil
+}
+
+// jsapiRequestDataV3 JSAPI调起支付的参数 https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_1_4.shtml
+func (cli *Client) jsapiRequestDataV3(prepayId string) (unipay.MapResult, error) {
+	nonce := nonceStr()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	pkg := "prepay_id=" + prepayId
+
+	sign, err := cli.v3.signLines(cli.appId, timestamp, nonce, pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"appId":     cli.appId,
+		"timeStamp": timestamp,
+		"nonceStr":  nonce,
+		"package":   pkg,
+		"signType":  "RSA",
+		"paySign":   sign,
+	}, nil
+}
+
+// notifyV3 处理APIv3的支付结果通知
+func (cli *Client) notifyV3(req *http.Request) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	var transaction transactionV3
+	noti, err := cli.v3.ParseNotification(req, &transaction)
+	if err != nil {
+		return err
+	}
+
+	if noti.EventType != "TRANSACTION.SUCCESS" || transaction.TradeState != TradeStateSuccess {
+		return nil
+	}
+
+	if transaction.AppId != cli.appId || transaction.MchId != cli.mchId {
+		return fmt.Errorf("%w: appid or mch_id", unipay.ErrBundleMismatch)
+	}
+
+	return cli.notification(transaction.TransactionId, noti.EventType, req, body, func() error {
+		return cli.paid(transaction.OutTradeNo, transaction.TransactionId, totalAmount(int64(transaction.Amount.Total), transaction.Amount.Currency))
+	})
+}
+
+// readBody 读取通知报文并重置req.Body, 用于保存原始报文
+func readBody(req *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func (cli *Client) queryV3(outTradeNo string) (*Trade, error) {
+	path := "/v3/pay/transactions/out-trade-no/" + url.PathEscape(outTradeNo) + "?mchid=" + url.QueryEscape(cli.mchId)
+
+	var transaction transactionV3
+	if err := cli.v3.Do(http.MethodGet, path, nil, &transaction); err != nil {
+		return nil, err
+	}
+
+	return transaction.trade(), nil
+}
+
+func (cli *Client) closeV3(outTradeNo string) error {
+	path := "/v3/pay/transactions/out-trade-no/" + url.PathEscape(outTradeNo) + "/close"
+	body := map[string]string{"mchid": cli.mchId}
+	return cli.v3.Do(http.MethodPost, path, body, nil)
+}
+
+func (cli *Client) refundV3(info *unipay.OrderInfo, outRefundNo string, refundFee int, reason string) (*Refund, error) {
+	obj := refundV3{
+		OutTradeNo:  info.OutTradeNo,
+		OutRefundNo: outRefundNo,
+		Reason:      reason,
+		NotifyURL:   cli.RefundNotifyURL,
+		Amount: amountV3{
+			Refund:   refundFee,
+			Total:    info.TotalFee,
+			Currency: orderAmount(info).Currency,
+		},
+	}
+
+	var resp refundV3Resp
+	if err := cli.v3.Do(http.MethodPost, "/v3/refund/domestic/refunds", obj, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.refund(), nil
+}
+
+func (cli *Client) refundQueryV3(outRefundNo string) (*Refund, error) {
+	var resp refundV3Resp
+	if err := cli.v3.Do(http.MethodGet, "/v3/refund/domestic/refunds/"+url.PathEscape(outRefundNo), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.refund(), nil
+}
+
+// refundNotifyV3 处理APIv3的退款结果通知, event_type: REFUND.SUCCESS | REFUND.ABNORMAL | REFUND.CLOSED
+func (cli *Client) refundNotifyV3(req *http.Request) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	var resource refundNotifyV3
+	if _, err := cli.v3.ParseNotification(req, &resource); err != nil {
+		return err
+	}
+
+	if resource.MchId != cli.mchId {
+		return fmt.Errorf("%w: mch_id", unipay.ErrBundleMismatch)
+	}
+
+	return cli.refundNotification(&Refund{
+		OutTradeNo:    resource.OutTradeNo,
+		TransactionId: resource.TransactionId,
+		OutRefundNo:   resource.OutRefundNo,
+		RefundId:      resource.RefundId,
+		TotalFee:      resource.Amount.Total,
+		RefundFee:     resource.Amount.Refund,
+		Status:        resource.RefundStatus,
+	}, req, body)
+}
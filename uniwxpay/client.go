@@ -1,7 +1,11 @@
 package uniwxpay
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lovewith99/unipay"
 	wxpayv2 "github.com/lovewith99/wxpay/v2"
@@ -11,49 +15,203 @@ type Client struct {
 	Config
 
 	client       *wxpayv2.Client
+	v3           *apiV3
+	Locker       unipay.Locker
+	LockOptions  unipay.LockOptions
 	OrderService unipay.OrderService
+
+	// NotificationStore 通知去重并保存原始报文, 可选
+	NotificationStore unipay.NotificationStore
+
+	// RequestSigner 下单前校验客户端请求签名, 可选
+	RequestSigner *unipay.RequestSigner
+
+	// ContractService 委托代扣签约/解约的回调, 使用委托代扣时必填, OrderService实现了ContractService时可不配置
+	ContractService ContractService
+
+	mu         sync.Mutex
+	sandboxKey string
 }
 
 func (cli *Client) Client() *wxpayv2.Client {
 	return cli.client
 }
 
+// Payment APP支付
 func (cli *Client) Payment(ctx *unipay.Context) (unipay.MapResult, error) {
-	svc := cli.OrderService
+	if cli.v3 != nil {
+		resp, err := cli.orderV3(ctx, "app", &orderV3{})
+		if err != nil {
+			return nil, err
+		}
+		return cli.appRequestDataV3(resp.PrepayId)
+	}
+
+	obj := wxpayv2.UnifiedOrder{}
+	obj.TradeType = wxpayv2.APP
 
-	order, err := svc.PostOrder(ctx)
+	resp, err := cli.unifiedOrder(ctx, &obj)
 	if err != nil {
 		return nil, err
 	}
 
+	return cli.requestData(resp)
+}
+
+// JSAPIPayment 公众号支付, 返回的参数用于调起JSAPI支付(paySign)
+func (cli *Client) JSAPIPayment(ctx *unipay.Context, openId string) (unipay.MapResult, error) {
+	if cli.v3 != nil {
+		resp, err := cli.orderV3(ctx, "jsapi", &orderV3{Payer: &payerV3{OpenId: openId}})
+		if err != nil {
+			return nil, err
+		}
+		return cli.jsapiRequestDataV3(resp.PrepayId)
+	}
+
 	obj := wxpayv2.UnifiedOrder{}
-	obj.TradeType = wxpayv2.APP
-	obj.SpbillCreateIp = ctx.ClientIP
-	obj.NotifyUrl = cli.NotifyURL
+	obj.TradeType = wxpayv2.JSAPI
+	obj.OpenId = openId
+
+	resp, err := cli.unifiedOrder(ctx, &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return cli.requestData(resp)
+}
+
+// MiniProgramPayment 小程序支付, 与公众号支付相同, Client需要使用小程序的appid创建
+func (cli *Client) MiniProgramPayment(ctx *unipay.Context, openId string) (unipay.MapResult, error) {
+	return cli.JSAPIPayment(ctx, openId)
+}
+
+// NativePayment 扫码支付, 返回的code_url由调用方生成二维码展示给用户
+func (cli *Client) NativePayment(ctx *unipay.Context, productId string) (unipay.MapResult, error) {
+	if cli.v3 != nil {
+		resp, err := cli.orderV3(ctx, "native", &orderV3{})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"code_url": resp.CodeUrl,
+		}, nil
+	}
+
+	obj := wxpayv2.UnifiedOrder{}
+	obj.TradeType = wxpayv2.NATIVE
+	obj.ProductId = productId
+
+	resp, err := cli.unifiedOrder(ctx, &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"prepay_id": resp.PrepayId,
+		"code_url":  resp.CodeUrl,
+	}, nil
+}
 
-	if cli.signType != "" {
-		obj.SignType = cli.signType
-	} else {
-		obj.SignType = wxpayv2.MD5
+// H5Payment H5支付, 返回的mweb_url用于在手机浏览器中拉起微信支付
+func (cli *Client) H5Payment(ctx *unipay.Context, scene *H5SceneInfo) (unipay.MapResult, error) {
+	if cli.v3 != nil {
+		obj := &orderV3{SceneInfo: &sceneInfoV3{
+			PayerClientIp: ctx.ClientIP,
+			H5Info:        newH5InfoV3(scene),
+		}}
+		resp, err := cli.orderV3(ctx, "h5", obj)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"mweb_url": resp.H5Url,
+		}, nil
+	}
+
+	sceneInfo, err := json.Marshal(map[string]interface{}{
+		"h5_info": scene,
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	obj := wxpayv2.UnifiedOrder{}
+	obj.TradeType = MWEB
+	obj.SceneInfo = string(sceneInfo)
+
+	resp, err := cli.unifiedOrder(ctx, &obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"prepay_id": resp.PrepayId,
+		"mweb_url":  resp.MwebUrl,
+	}, nil
+}
+
+// postOrder 创建订单, 配置了RequestSigner时先校验客户端请求签名
+// 各支付方式, APIv3下单和委托代扣都通过postOrder创建订单, 每个请求只校验一次
+func (cli *Client) postOrder(ctx *unipay.Context) (unipay.IOrder, error) {
+	if err := cli.RequestSigner.Verify(&ctx.Request); err != nil {
+		return nil, err
+	}
+	return cli.OrderService.PostOrder(ctx)
+}
+
+// unifiedOrder 创建订单并调用统一下单接口
+func (cli *Client) unifiedOrder(ctx *unipay.Context, obj *wxpayv2.UnifiedOrder) (*unifiedOrderResp, error) {
+	order, err := cli.postOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	obj.SpbillCreateIp = ctx.ClientIP
+	obj.NotifyUrl = cli.NotifyURL
+
 	info := order.OrderInfo()
 	obj.Body = info.Subject
 	obj.OutTradeNo = info.OutTradeNo
 	obj.TotalFee = info.TotalFee
+	obj.FeeType = orderAmount(info).Currency
 	obj.Attach = info.Attach
 
-	var resp wxpayv2.UnifiedOrderResp
-	if err := cli.client.Do(&obj, &resp); err != nil {
+	if info.Timeout > 0 {
+		now := time.Now().In(timeLocation)
+		obj.TimeStart = now.Format(timeFormat)
+		obj.TimeExpire = now.Add(info.Timeout).Format(timeFormat)
+	}
+
+	var resp unifiedOrderResp
+	if err := cli.do(obj, &resp); err != nil {
 		return nil, err
 	}
 
 	if !resp.IsSuccess() {
-		return nil, errors.New(resp.ReturnMsg)
+		return nil, respError(resp.ReturnCode, resp.ReturnMsg, resp.ErrCode, resp.ErrCodeDes)
 	}
 
-	data := resp.RequestData(cli.client)
-	return data, nil
+	return &resp, nil
+}
+
+// retryableCodes 微信支付的临时错误码, 可使用相同参数重试
+var retryableCodes = map[string]bool{
+	"SYSTEMERROR":       true,
+	"BANKERROR":         true,
+	"FREQUENCY_LIMITED": true,
+}
+
+// respError 根据return_code返回通信错误或业务错误
+func respError(returnCode, returnMsg, errCode, errCodeDes string) error {
+	if returnCode != "SUCCESS" {
+		return &unipay.ProviderError{PayWay: unipay.PayWay_WxPay, Code: returnCode, Message: returnMsg}
+	}
+	return &unipay.ProviderError{
+		PayWay:    unipay.PayWay_WxPay,
+		Code:      errCode,
+		Message:   errCodeDes,
+		Retryable: retryableCodes[errCode],
+	}
 }
 
 type ClientOption func(*Client)
@@ -69,6 +227,21 @@ func NewClient(appId, mchdId, key string, opts ...ClientOption) (*Client, error)
 		opt(cli)
 	}
 
+	switch cli.signType {
+	case "", wxpayv2.MD5, wxpayv2.HMAC_SHA256:
+	default:
+		return nil, fmt.Errorf("uniwxpay: unsupported sign type %s", cli.signType)
+	}
+
+	if cli.Locker == nil {
+		cli.Locker = unipay.LockerImpl{}
+	}
+
+	if cli.domain == "" {
+		cli.domain = defaultDomain
+	}
+	cli.domain = strings.TrimSuffix(cli.domain, "/")
+
 	wxpayopts := make([]func(*wxpayv2.Client) error, 0)
 	if cli.certPem != "" && cli.keyPem != "" {
 		wxpayopts = append(wxpayopts,
@@ -81,6 +254,14 @@ func NewClient(appId, mchdId, key string, opts ...ClientOption) (*Client, error)
 		return nil, err
 	}
 
+	if cli.apiV3Key != "" {
+		cli.v3, err = newAPIv3(cli.mchId, cli.mchSerialNo, cli.mchPrivateKey, cli.apiV3Key, cli.client.Client)
+		if err != nil {
+			return nil, err
+		}
+		cli.v3.domain = cli.domain
+	}
+
 	return cli, err
 }
 
@@ -98,6 +279,53 @@ func NotifyURL(uri string) ClientOption {
 	}
 }
 
+// RefundNotifyURL 退款结果通知地址
+func RefundNotifyURL(uri string) ClientOption {
+	return func(cli *Client) {
+		cli.RefundNotifyURL = uri
+	}
+}
+
+// QueryInvoke 开启后, Query查询到已支付而OrderService中尚未支付的订单时执行Invoke, 用于补偿丢失的支付通知
+func QueryInvoke(enable bool) ClientOption {
+	return func(cli *Client) {
+		cli.QueryInvoke = enable
+	}
+}
+
+// APIv3 使用微信支付APIv3, 需要APIv3密钥, 商户API证书序列号和商户API私钥(PEM)
+// 平台证书由Client自动下载并缓存
+func APIv3(apiV3Key, mchSerialNo string, mchPrivateKey []byte) ClientOption {
+	return func(cli *Client) {
+		cli.apiV3Key = apiV3Key
+		cli.mchSerialNo = mchSerialNo
+		cli.mchPrivateKey = mchPrivateKey
+	}
+}
+
+// SignType v2接口的签名类型, wxpayv2.MD5 | wxpayv2.HMAC_SHA256, 推荐使用HMAC-SHA256, 其他值NewClient返回错误
+// 下单, 客户端调起支付的参数, 返回结果和通知的验签均使用该签名类型, 默认MD5
+func SignType(signType string) ClientOption {
+	return func(cli *Client) {
+		cli.signType = signType
+	}
+}
+
+// Sandbox 使用仿真测试系统(sandboxnew), 签名密钥由接口获取, 签名类型固定为MD5
+// 仅对v2接口生效, APIv3没有仿真测试系统
+func Sandbox(enable bool) ClientOption {
+	return func(cli *Client) {
+		cli.sandbox = enable
+	}
+}
+
+// Domain 接口域名, 默认https://api.mch.weixin.qq.com, 可配置为备用域名或本地的模拟服务
+func Domain(domain string) ClientOption {
+	return func(cli *Client) {
+		cli.domain = domain
+	}
+}
+
 func TLSCertFiles(certPem, keyPem string) ClientOption {
 	return func(cli *Client) {
 		cli.certPem = certPem
@@ -110,3 +338,37 @@ func WithOrderService(svc unipay.OrderService) ClientOption {
 		cli.OrderService = svc
 	}
 }
+
+// WithContractService 委托代扣签约/解约的回调
+func WithContractService(svc ContractService) ClientOption {
+	return func(cli *Client) {
+		cli.ContractService = svc
+	}
+}
+
+func WithLocker(locker unipay.Locker) ClientOption {
+	return func(cli *Client) {
+		cli.Locker = locker
+	}
+}
+
+// WithLockOptions 处理支付/退款通知时按out_trade_no加锁, 可配置锁的过期时间和等待时间
+func WithLockOptions(opts unipay.LockOptions) ClientOption {
+	return func(cli *Client) {
+		cli.LockOptions = opts
+	}
+}
+
+// WithRequestSigner 统一下单和委托代扣扣款前校验客户端请求的签名, 时间戳和nonce
+func WithRequestSigner(signer *unipay.RequestSigner) ClientOption {
+	return func(cli *Client) {
+		cli.RequestSigner = signer
+	}
+}
+
+// WithNotificationStore 支付/退款/签约通知去重, 以transaction_id, refund_id, contract_id作为通知ID
+func WithNotificationStore(store unipay.NotificationStore) ClientOption {
+	return func(cli *Client) {
+		cli.NotificationStore = store
+	}
+}
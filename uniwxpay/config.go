@@ -1,5 +1,41 @@
 package uniwxpay
 
+import (
+	"time"
+
+	wxpayv2 "github.com/lovewith99/wxpay/v2"
+)
+
+// MWEB H5支付, wxpayv2 未定义该交易类型
+const MWEB = "MWEB"
+
+// CNY 微信支付默认的货币类型
+const CNY = "CNY"
+
+// defaultDomain 微信支付接口域名
+const defaultDomain = "https://api.mch.weixin.qq.com"
+
+const timeFormat = "20060102150405"
+
+// timeLocation 微信支付接口的时间均为北京时间
+var timeLocation = time.FixedZone("CST", 8*3600)
+
+// H5SceneInfo H5支付的场景信息
+type H5SceneInfo struct {
+	Type        string `json:"type"`                   // 场景类型: Wap | IOS | Android
+	WapURL      string `json:"wap_url,omitempty"`      // WAP网站URL地址
+	WapName     string `json:"wap_name,omitempty"`     // WAP网站名
+	AppName     string `json:"app_name,omitempty"`     // 应用名
+	BundleId    string `json:"bundle_id,omitempty"`    // iOS平台bundle_id
+	PackageName string `json:"package_name,omitempty"` // Android平台包名
+}
+
+// unifiedOrderResp 统一下单返回结果, wxpayv2.UnifiedOrderResp 缺少H5支付的mweb_url
+type unifiedOrderResp struct {
+	wxpayv2.UnifiedOrderResp
+	MwebUrl string `xml:"mweb_url,omitempty"`
+}
+
 type Config struct {
 	appId    string
 	mchId    string
@@ -7,6 +43,15 @@ type Config struct {
 	certPem  string
 	keyPem   string
 	signType string
+	sandbox  bool
+	domain   string
+
+	// APIv3
+	apiV3Key      string
+	mchSerialNo   string
+	mchPrivateKey []byte
 
-	NotifyURL string
+	NotifyURL       string
+	RefundNotifyURL string
+	QueryInvoke     bool
 }
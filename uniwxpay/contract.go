@@ -0,0 +1,368 @@
+package uniwxpay
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/lovewith99/unipay"
+	wxpayv2 "github.com/lovewith99/wxpay/v2"
+)
+
+// PAP 委托代扣的交易类型
+const PAP = "PAP"
+
+// 签约变更类型
+const (
+	ContractChangeTypeAdd    = "ADD"    // 签约
+	ContractChangeTypeDelete = "DELETE" // 解约
+)
+
+// 协议状态
+const (
+	ContractStateSigned     = "0" // 已签约
+	ContractStateTerminated = "1" // 已解约
+)
+
+// contractVersion 委托代扣接口的版本号
+const contractVersion = "1.0"
+
+// Contract 微信支付委托代扣协议
+type Contract struct {
+	ContractId             string // 微信支付委托代扣协议id
+	PlanId                 string // 模板id
+	ContractCode           string // 商户签约协议号
+	RequestSerial          string // 商户请求签约的序列号
+	OpenId                 string // 用户标识
+	State                  string // 协议状态, ContractStateSigned | ContractStateTerminated
+	SignedTime             string // 签约时间
+	ExpiredTime            string // 协议到期时间
+	TerminatedTime         string // 解约时间
+	TerminationMode        string // 解约方式: 0-未解约 1-有效期过自动解约 2-用户主动解约 3-商户API解约 4-商户平台解约 5-注销
+	TerminationRemark      string // 解约备注
+	ContractDisplayAccount string // 签约页面展示的用户账户名称
+	OperateTime            string // 签约/解约的操作时间, 仅通知时返回
+	ChangeType             string // 签约变更类型, 仅通知时返回
+}
+
+// ContractService 委托代扣协议的处理接口
+// 签约/解约的结果通过该接口回调, 未配置时若OrderService实现了该接口则使用OrderService
+// 使用委托代扣时必须配置, 否则签约, 解约和签约/解约通知返回错误
+// 扣款订单与普通订单一样, 由支付结果通知走OrderService的Invoke流程
+type ContractService interface {
+	// Sign 用户签约成功
+	Sign(contract *Contract) error
+
+	// Terminate 协议解约, 执行与Sign相反的逻辑, 如关闭自动续费
+	Terminate(contract *Contract) error
+}
+
+// ContractSign 签约参数
+type ContractSign struct {
+	PlanId                 string // 模板id, 在商户平台配置
+	ContractCode           string // 商户签约协议号, 需保证在商户系统中唯一
+	RequestSerial          int64  // 商户请求签约的序列号, 需保证在商户系统中唯一
+	ContractDisplayAccount string // 展示在签约页面的用户账户名称
+}
+
+func (sign *ContractSign) values(cli *Client) url.Values {
+	values := url.Values{}
+	values.Set("appid", cli.appId)
+	values.Set("mch_id", cli.mchId)
+	values.Set("plan_id", sign.PlanId)
+	values.Set("contract_code", sign.ContractCode)
+	values.Set("request_serial", strconv.FormatInt(sign.RequestSerial, 10))
+	values.Set("contract_display_account", sign.ContractDisplayAccount)
+	values.Set("notify_url", cli.NotifyURL)
+	values.Set("version", contractVersion)
+	values.Set("timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	return values
+}
+
+// preEntrustWebReq APP纯签约的预签约请求
+type preEntrustWebReq struct {
+	wxpayv2.Request
+
+	PlanId                 string `xml:"plan_id"`
+	ContractCode           string `xml:"contract_code"`
+	RequestSerial          int64  `xml:"request_serial"`
+	ContractDisplayAccount string `xml:"contract_display_account"`
+	NotifyUrl              string `xml:"notify_url"`
+	Version                string `xml:"version"`
+	Timestamp              string `xml:"timestamp"`
+}
+
+func (req *preEntrustWebReq) GateWay() string {
+	return defaultDomain + "/papay/preentrustweb"
+}
+
+// queryContractReq 查询签约关系
+type queryContractReq struct {
+	wxpayv2.Request
+
+	ContractId string `xml:"contract_id"`
+	Version    string `xml:"version"`
+}
+
+func (req *queryContractReq) GateWay() string {
+	return defaultDomain + "/papay/querycontract"
+}
+
+// deleteContractReq 申请解约
+type deleteContractReq struct {
+	wxpayv2.Request
+
+	ContractId                string `xml:"contract_id"`
+	ContractTerminationRemark string `xml:"contract_termination_remark"`
+	Version                   string `xml:"version"`
+}
+
+func (req *deleteContractReq) GateWay() string {
+	return defaultDomain + "/papay/deletecontract"
+}
+
+// papPayApplyReq 申请扣款
+type papPayApplyReq struct {
+	wxpayv2.Request
+
+	Body           string `xml:"body"`
+	OutTradeNo     string `xml:"out_trade_no"`
+	TotalFee       int    `xml:"total_fee"`
+	FeeType        string `xml:"fee_type,omitempty"`
+	SpbillCreateIp string `xml:"spbill_create_ip"`
+	NotifyUrl      string `xml:"notify_url"`
+	TradeType      string `xml:"trade_type"`
+	ContractId     string `xml:"contract_id"`
+	Attach         string `xml:"attach,omitempty"`
+}
+
+func (req *papPayApplyReq) GateWay() string {
+	return defaultDomain + "/pay/pappayapply"
+}
+
+// ContractWebSign 公众号纯签约, 返回的sign_url在微信内打开完成签约
+// https://pay.weixin.qq.com/wiki/doc/api/pap.php?chapter=18_1&index=1
+func (cli *Client) ContractWebSign(sign *ContractSign) (unipay.MapResult, error) {
+	if _, err := cli.contractService(); err != nil {
+		return nil, err
+	}
+
+	values := sign.values(cli)
+	if err := cli.signValues(values, wxpayv2.MD5); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"sign_url": cli.gateway(defaultDomain+"/papay/entrustweb") + "?" + values.Encode(),
+	}, nil
+}
+
+// ContractAppSign APP纯签约, 返回的pre_entrustweb_id由APP通过OpenSDK拉起签约页面
+// https://pay.weixin.qq.com/wiki/doc/api/pap.php?chapter=18_5&index=2
+func (cli *Client) ContractAppSign(sign *ContractSign) (unipay.MapResult, error) {
+	if _, err := cli.contractService(); err != nil {
+		return nil, err
+	}
+
+	obj := preEntrustWebReq{}
+	obj.PlanId = sign.PlanId
+	obj.ContractCode = sign.ContractCode
+	obj.RequestSerial = sign.RequestSerial
+	obj.ContractDisplayAccount = sign.ContractDisplayAccount
+	obj.NotifyUrl = cli.NotifyURL
+	obj.Version = contractVersion
+	obj.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+
+	params, err := cli.doParams(&obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"pre_entrustweb_id": params.GetString("pre_entrustweb_id"),
+	}, nil
+}
+
+// ContractH5Sign H5纯签约, 返回的redirect_url在手机浏览器中打开拉起微信完成签约
+// https://pay.weixin.qq.com/wiki/doc/api/pap.php?chapter=18_16&index=4
+func (cli *Client) ContractH5Sign(ctx *unipay.Context, sign *ContractSign) (unipay.MapResult, error) {
+	if _, err := cli.contractService(); err != nil {
+		return nil, err
+	}
+
+	values := sign.values(cli)
+	values.Set("clientip", ctx.ClientIP)
+
+	// H5纯签约只支持HMAC-SHA256签名
+	if err := cli.signValues(values, wxpayv2.HMAC_SHA256); err != nil {
+		return nil, err
+	}
+
+	resp, err := cli.client.Client.Get(cli.gateway(defaultDomain+"/papay/h5entrustweb") + "?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	params, err := ParseParams(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.GetString("return_code") != "SUCCESS" || params.GetString("result_code") != "SUCCESS" {
+		return nil, respError(params.GetString("return_code"), params.GetString("return_msg"),
+			params.GetString("err_code"), params.GetString("err_code_des"))
+	}
+
+	return map[string]interface{}{
+		"redirect_url": params.GetString("redirect_url"),
+	}, nil
+}
+
+// ContractQuery 查询签约关系
+func (cli *Client) ContractQuery(contractId string) (*Contract, error) {
+	obj := queryContractReq{}
+	obj.ContractId = contractId
+	obj.Version = contractVersion
+
+	params, err := cli.doParams(&obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return contractFromParams(params), nil
+}
+
+// ContractTerminate 商户主动解约
+// 解约结果由微信支付通过签约通知(change_type=DELETE)异步回调, 在Notify中调用ContractService.Terminate
+func (cli *Client) ContractTerminate(contractId, remark string) error {
+	if _, err := cli.contractService(); err != nil {
+		return err
+	}
+
+	obj := deleteContractReq{}
+	obj.ContractId = contractId
+	obj.ContractTerminationRemark = remark
+	obj.Version = contractVersion
+
+	_, err := cli.doParams(&obj)
+	return err
+}
+
+// ContractDeduct 根据委托代扣协议发起扣款
+// 申请扣款成功只表示微信支付已受理, 扣款结果通过支付结果通知, 由Notify执行OrderService.Invoke
+func (cli *Client) ContractDeduct(ctx *unipay.Context, contractId string) (unipay.MapResult, error) {
+	order, err := cli.postOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info := order.OrderInfo()
+	obj := papPayApplyReq{}
+	obj.Body = info.Subject
+	obj.OutTradeNo = info.OutTradeNo
+	obj.TotalFee = info.TotalFee
+	obj.FeeType = orderAmount(info).Currency
+	obj.Attach = info.Attach
+	obj.SpbillCreateIp = ctx.ClientIP
+	obj.NotifyUrl = cli.NotifyURL
+	obj.TradeType = PAP
+	obj.ContractId = contractId
+
+	if _, err := cli.doParams(&obj); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"out_trade_no": info.OutTradeNo,
+	}, nil
+}
+
+// contractService 签约/解约的回调, 未配置ContractService时使用实现了ContractService的OrderService
+func (cli *Client) contractService() (ContractService, error) {
+	if cli.ContractService != nil {
+		return cli.ContractService, nil
+	}
+	if svc, ok := cli.OrderService.(ContractService); ok {
+		return svc, nil
+	}
+	return nil, errors.New("uniwxpay: ContractService required")
+}
+
+// contractNotify 处理签约/解约通知
+func (cli *Client) contractNotify(params wxpayv2.Params) error {
+	if params.GetString("mch_id") != cli.mchId {
+		return fmt.Errorf("%w: mch_id", unipay.ErrBundleMismatch)
+	}
+
+	if params.GetString("result_code") != "SUCCESS" {
+		return nil
+	}
+
+	// 未配置ContractService时返回错误, 微信会重复通知, 不能丢弃签约/解约事件
+	svc, err := cli.contractService()
+	if err != nil {
+		return err
+	}
+
+	contract := contractFromParams(params)
+	switch contract.ChangeType {
+	case ContractChangeTypeAdd:
+		return svc.Sign(contract)
+	case ContractChangeTypeDelete:
+		return svc.Terminate(contract)
+	}
+
+	return nil
+}
+
+// signValues 对url参数签名, 签约页面的参数通过url传递
+func (cli *Client) signValues(values url.Values, signType string) error {
+	key, err := cli.signKey()
+	if err != nil {
+		return err
+	}
+
+	hm := make(map[string]interface{})
+	for k := range values {
+		if v := values.Get(k); v != "" {
+			hm[k] = v
+		}
+	}
+
+	values.Set("sign", wxpayv2.MakeSign(hm, key, signType))
+	return nil
+}
+
+func contractFromParams(params wxpayv2.Params) *Contract {
+	contract := &Contract{
+		ContractId:             params.GetString("contract_id"),
+		PlanId:                 params.GetString("plan_id"),
+		ContractCode:           params.GetString("contract_code"),
+		RequestSerial:          params.GetString("request_serial"),
+		OpenId:                 params.GetString("openid"),
+		State:                  params.GetString("contract_state"),
+		SignedTime:             params.GetString("contract_signed_time"),
+		ExpiredTime:            params.GetString("contract_expired_time"),
+		TerminatedTime:         params.GetString("contract_terminated_time"),
+		TerminationMode:        params.GetString("contract_termination_mode"),
+		TerminationRemark:      params.GetString("contract_termination_remark"),
+		ContractDisplayAccount: params.GetString("contract_display_account"),
+		OperateTime:            params.GetString("operate_time"),
+		ChangeType:             params.GetString("change_type"),
+	}
+
+	// 通知中不返回协议状态, 根据变更类型补全
+	if contract.State == "" {
+		switch contract.ChangeType {
+		case ContractChangeTypeAdd:
+			contract.State = ContractStateSigned
+		case ContractChangeTypeDelete:
+			contract.State = ContractStateTerminated
+		}
+	}
+
+	return contract
+}
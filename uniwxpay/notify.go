@@ -0,0 +1,249 @@
+package uniwxpay
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/lovewith99/unipay"
+	wxpayv2 "github.com/lovewith99/wxpay/v2"
+)
+
+// ParseParams 解析微信支付的xml报文
+func ParseParams(r io.Reader) (wxpayv2.Params, error) {
+	var params xmlParams
+	if err := xml.NewDecoder(r).Decode(&params); err != nil {
+		return nil, err
+	}
+
+	return wxpayv2.Params(params), nil
+}
+
+// xmlParams 将xml报文的一级节点解析为键值对, 根节点名称不限(退款通知解密后的根节点为root)
+type xmlParams wxpayv2.Params
+
+func (p *xmlParams) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	params := make(xmlParams)
+
+	var key string
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			key = t.Name.Local
+		case xml.CharData:
+			if key != "" {
+				params[key] += string(t)
+			}
+		case xml.EndElement:
+			if t.Name == start.Name {
+				*p = params
+				return nil
+			}
+			key = ""
+		}
+	}
+}
+
+// VerifySign 使用SignType配置的签名类型验证微信支付报文的签名
+// 报文中的sign_type不可信, 与配置不一致时验签失败, 防止降级为MD5
+func (cli *Client) VerifySign(params wxpayv2.Params) bool {
+	key, err := cli.signKey()
+	if err != nil {
+		return false
+	}
+
+	signType := cli.requestSignType()
+	if st := params.GetString("sign_type"); st != "" && st != signType {
+		return false
+	}
+
+	return verifySign(params, key, signType)
+}
+
+// Notify 处理微信支付结果通知和委托代扣的签约/解约通知, 返回nil时需要应答SUCCESS, 否则微信会重复通知
+func (cli *Client) Notify(req *http.Request) error {
+	if isNotifyV3(req) {
+		if cli.v3 == nil {
+			return errors.New("uniwxpay: APIv3 not configured")
+		}
+		return cli.notifyV3(req)
+	}
+
+	defer req.Body.Close()
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	params, err := ParseParams(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if params.GetString("return_code") != "SUCCESS" {
+		return respError(params.GetString("return_code"), params.GetString("return_msg"), "", "")
+	}
+
+	if !cli.VerifySign(params) {
+		return fmt.Errorf("%w: wxpay", unipay.ErrSignatureInvalid)
+	}
+
+	// 委托代扣的签约/解约通知与支付结果通知使用同一个通知地址
+	if changeType := params.GetString("change_type"); changeType != "" {
+		return cli.notification(params.GetString("contract_id")+"_"+changeType, changeType, req, body, func() error {
+			return cli.contractNotify(params)
+		})
+	}
+
+	if params.GetString("appid") != cli.appId || params.GetString("mch_id") != cli.mchId {
+		return fmt.Errorf("%w: appid or mch_id", unipay.ErrBundleMismatch)
+	}
+
+	// 支付失败, 不需要处理
+	if params.GetString("result_code") != "SUCCESS" {
+		return nil
+	}
+
+	totalFee, _ := strconv.ParseInt(params.GetString("total_fee"), 10, 64)
+	return cli.notification(params.GetString("transaction_id"), "TRANSACTION.SUCCESS", req, body, func() error {
+		return cli.paid(params.GetString("out_trade_no"), params.GetString("transaction_id"), totalAmount(totalFee, params.GetString("fee_type")))
+	})
+}
+
+// notification 配置了NotificationStore时跳过已处理成功的通知, 并保存原始报文
+func (cli *Client) notification(id, typ string, req *http.Request, body []byte, handle func() error) error {
+	return unipay.ProcessNotification(cli.NotificationStore, &unipay.Notification{
+		PayWay:  unipay.PayWay_WxPay,
+		ID:      id,
+		Type:    typ,
+		Header:  req.Header,
+		Payload: body,
+	}, handle)
+}
+
+// paid 校验订单金额和币种并处理已支付的订单, transactionId保存为订单的TradeNo
+func (cli *Client) paid(outTradeNo, transactionId string, amount unipay.Money) error {
+	order, err := cli.OrderService.GetOrderByTradeNo(outTradeNo, unipay.PayWay_WxPay)
+	if err != nil {
+		return err
+	}
+
+	if !amount.Equal(orderAmount(order.OrderInfo())) {
+		return fmt.Errorf("%w: %s", unipay.ErrAmountMismatch, outTradeNo)
+	}
+
+	return cli.invoke(outTradeNo, transactionId)
+}
+
+// totalAmount 微信支付金额, 单位分, 币种为空时为CNY
+func totalAmount(fee int64, currency string) unipay.Money {
+	if currency == "" {
+		currency = CNY
+	}
+	return unipay.NewMoney(fee, currency)
+}
+
+// orderAmount 订单金额, 订单币种为空时为CNY
+func orderAmount(info *unipay.OrderInfo) unipay.Money {
+	return totalAmount(int64(info.TotalFee), info.Currency)
+}
+
+// isNotifyV3 APIv3的通知在请求头中携带签名
+func isNotifyV3(req *http.Request) bool {
+	return req.Header.Get("Wechatpay-Signature") != ""
+}
+
+// NotifyHandler 微信支付结果通知的http.Handler
+func (cli *Client) NotifyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		v3 := isNotifyV3(req)
+		if err := cli.Notify(req); err != nil {
+			if v3 {
+				WriteNotifyReplyV3(w, err)
+			} else {
+				WriteNotifyReply(w, "FAIL", err.Error())
+			}
+			return
+		}
+
+		if v3 {
+			WriteNotifyReplyV3(w, nil)
+		} else {
+			WriteNotifyReply(w, "SUCCESS", "OK")
+		}
+	})
+}
+
+// WriteNotifyReplyV3 应答APIv3的通知, 处理成功时返回204, 失败时返回500
+func WriteNotifyReplyV3(w http.ResponseWriter, err error) {
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":    "FAIL",
+		"message": err.Error(),
+	})
+}
+
+// WriteNotifyReply 应答微信支付的通知
+func WriteNotifyReply(w http.ResponseWriter, code, msg string) {
+	reply := struct {
+		XMLName    struct{} `xml:"xml"`
+		ReturnCode string   `xml:"return_code"`
+		ReturnMsg  string   `xml:"return_msg"`
+	}{
+		ReturnCode: code,
+		ReturnMsg:  msg,
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(reply)
+}
+
+// Invoke 处理已支付的订单
+func (cli *Client) Invoke(outTradeNo string) error {
+	return cli.invoke(outTradeNo, "")
+}
+
+func (cli *Client) invoke(outTradeNo, transactionId string) error {
+	unlock, err := unipay.AcquireLock(cli.Locker, outTradeNo, cli.LockOptions)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	svc := cli.OrderService
+	order, err := svc.GetOrderByTradeNo(outTradeNo, unipay.PayWay_WxPay)
+	if err != nil {
+		return err
+	}
+
+	if err := unipay.CheckTransition(order, unipay.OrderEventPay); err != nil {
+		// 订单已处理，直接返回
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	if transactionId != "" {
+		order.OrderInfo().TradeNo = transactionId
+	}
+	return svc.Invoke(order)
+}
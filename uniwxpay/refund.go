@@ -0,0 +1,286 @@
+package uniwxpay
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/lovewith99/unipay"
+	wxpayv2 "github.com/lovewith99/wxpay/v2"
+)
+
+// refundReq 申请退款参数, wxpayv2.RefundReq 缺少退款结果通知地址notify_url
+type refundReq struct {
+	wxpayv2.RefundReq
+	NotifyUrl string `xml:"notify_url,omitempty"`
+}
+
+// Refund 申请退款, outRefundNo为商户退款单号, 每笔退款唯一, 相同退款单号重复调用不会重复退款
+// 退款申请成功只表示微信支付已受理, 退款结果通过退款通知(RefundNotify)或RefundQuery获取
+// 非APIv3模式下需要通过TLSCertFiles配置商户证书
+// 未支付或已全额退款的订单返回unipay.ErrOrderNotPaid | unipay.ErrOrderRefunded
+func (cli *Client) Refund(order unipay.IOrder, outRefundNo string, refundFee int, reason string) (*Refund, error) {
+	if outRefundNo == "" {
+		return nil, errors.New("uniwxpay: out_refund_no required")
+	}
+
+	info := order.OrderInfo()
+
+	event := unipay.OrderEventRefund
+	if refundFee < info.TotalFee {
+		event = unipay.OrderEventPartialRefund
+	}
+
+	// 未支付或已全额退款的订单不能退款
+	if err := unipay.CheckTransition(order, event); err != nil {
+		return nil, err
+	}
+
+	if cli.v3 != nil {
+		return cli.refundV3(info, outRefundNo, refundFee, reason)
+	}
+
+	if cli.certPem == "" || cli.keyPem == "" {
+		return nil, errors.New("uniwxpay: refund requires TLSCertFiles")
+	}
+
+	obj := refundReq{}
+	obj.OutTradeNo = info.OutTradeNo
+	obj.OutRefundNo = outRefundNo
+	obj.TotalFee = info.TotalFee
+	obj.RefundFee = refundFee
+	obj.RefundFeeType = orderAmount(info).Currency
+	obj.RefundDesc = reason
+	obj.NotifyUrl = cli.RefundNotifyURL
+
+	var resp wxpayv2.RefundResp
+	if err := cli.do(&obj, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.ReturnCode != "SUCCESS" || resp.ResultCode != "SUCCESS" {
+		return nil, respError(resp.ReturnCode, resp.ReturnMsg, resp.ErrCode, resp.ErrCodeDes)
+	}
+
+	return &Refund{
+		OutTradeNo:    resp.OutTradeNo,
+		TransactionId: resp.TransactionId,
+		OutRefundNo:   resp.OutRefundNo,
+		RefundId:      resp.RefundId,
+		TotalFee:      resp.TotalFee,
+		RefundFee:     resp.RefundFee,
+		Status:        RefundStatusProcessing,
+	}, nil
+}
+
+// RefundQuery 根据商户退款单号查询退款
+func (cli *Client) RefundQuery(outRefundNo string) (*Refund, error) {
+	if cli.v3 != nil {
+		return cli.refundQueryV3(outRefundNo)
+	}
+
+	obj := wxpayv2.RefundQueryReq{}
+	obj.OutRefundNo = outRefundNo
+
+	// 返回结果中的退款信息以_$n为后缀, 无法直接解析到wxpayv2.RefundQueryResp
+	params, err := cli.doParams(&obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// 按退款单号查询, 只会返回一笔退款
+	totalFee, _ := strconv.Atoi(params.GetString("total_fee"))
+	refundFee, _ := strconv.Atoi(params.GetString("refund_fee_0"))
+	return &Refund{
+		OutTradeNo:    params.GetString("out_trade_no"),
+		TransactionId: params.GetString("transaction_id"),
+		OutRefundNo:   params.GetString("out_refund_no_0"),
+		RefundId:      params.GetString("refund_id_0"),
+		TotalFee:      totalFee,
+		RefundFee:     refundFee,
+		Status:        refundStatus(params.GetString("refund_status_0")),
+	}, nil
+}
+
+// refundStatus 将v2接口的退款状态转换为与APIv3一致的状态
+func refundStatus(status string) string {
+	switch status {
+	case "REFUNDCLOSE":
+		return RefundStatusClosed
+	case "CHANGE":
+		return RefundStatusAbnormal
+	}
+	return status
+}
+
+// DecryptReqInfo 解密退款通知中的req_info
+// 解密方式: base64解码, 以商户key的MD5(小写)为密钥做AES-256-ECB解密, PKCS7去除填充
+func (cli *Client) DecryptReqInfo(reqInfo string) (wxpayv2.Params, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(reqInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := md5.Sum([]byte(cli.key))
+	block, err := aes.NewCipher([]byte(hex.EncodeToString(sum[:])))
+	if err != nil {
+		return nil, err
+	}
+
+	size := block.BlockSize()
+	if len(ciphertext) == 0 || len(ciphertext)%size != 0 {
+		return nil, errors.New("uniwxpay: invalid req_info length")
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	for i := 0; i < len(ciphertext); i += size {
+		block.Decrypt(plaintext[i:i+size], ciphertext[i:i+size])
+	}
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > size {
+		return nil, errors.New("uniwxpay: invalid req_info padding")
+	}
+
+	return ParseParams(bytes.NewReader(plaintext[:len(plaintext)-padding]))
+}
+
+// RefundNotify 处理退款结果通知, 返回nil时需要应答SUCCESS, 否则微信会重复通知
+// 全额退款调用OrderService.Revoke, 部分退款调用unipay.PartialRefundService
+func (cli *Client) RefundNotify(req *http.Request) error {
+	if isNotifyV3(req) {
+		if cli.v3 == nil {
+			return errors.New("uniwxpay: APIv3 not configured")
+		}
+		return cli.refundNotifyV3(req)
+	}
+
+	defer req.Body.Close()
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	params, err := ParseParams(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if params.GetString("return_code") != "SUCCESS" {
+		return respError(params.GetString("return_code"), params.GetString("return_msg"), "", "")
+	}
+
+	// 退款通知没有签名, req_info能够使用商户key解密即可证明通知来自微信支付
+	if params.GetString("appid") != cli.appId || params.GetString("mch_id") != cli.mchId {
+		return fmt.Errorf("%w: appid or mch_id", unipay.ErrBundleMismatch)
+	}
+
+	info, err := cli.DecryptReqInfo(params.GetString("req_info"))
+	if err != nil {
+		return err
+	}
+
+	totalFee, _ := strconv.Atoi(info.GetString("total_fee"))
+	refundFee, _ := strconv.Atoi(info.GetString("refund_fee"))
+	refund := &Refund{
+		OutTradeNo:    info.GetString("out_trade_no"),
+		TransactionId: info.GetString("transaction_id"),
+		OutRefundNo:   info.GetString("out_refund_no"),
+		RefundId:      info.GetString("refund_id"),
+		TotalFee:      totalFee,
+		RefundFee:     refundFee,
+		Status:        refundStatus(info.GetString("refund_status")),
+	}
+	return cli.refundNotification(refund, req, body)
+}
+
+// refundNotification 同一笔退款的不同状态分别通知, 以refund_id和退款状态作为通知ID
+func (cli *Client) refundNotification(refund *Refund, req *http.Request, body []byte) error {
+	return cli.notification(refund.RefundId+"_"+refund.Status, "REFUND."+refund.Status, req, body, func() error {
+		return cli.refunded(refund)
+	})
+}
+
+// RefundNotifyHandler 退款结果通知的http.Handler
+func (cli *Client) RefundNotifyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		v3 := isNotifyV3(req)
+		err := cli.RefundNotify(req)
+
+		switch {
+		case v3:
+			WriteNotifyReplyV3(w, err)
+		case err != nil:
+			WriteNotifyReply(w, "FAIL", err.Error())
+		default:
+			WriteNotifyReply(w, "SUCCESS", "OK")
+		}
+	})
+}
+
+// refunded 处理退款成功的订单, 退款关闭或异常时不做处理
+// 多笔部分退款累计达到订单金额时撤销订单, 累计退款金额通过unipay.RefundedOrder获取
+func (cli *Client) refunded(refund *Refund) error {
+	if refund.Status != RefundStatusSuccess {
+		return nil
+	}
+
+	outTradeNo := refund.OutTradeNo
+	unlock, err := unipay.AcquireLock(cli.Locker, outTradeNo, cli.LockOptions)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	svc := cli.OrderService
+	order, err := svc.GetOrderByTradeNo(outTradeNo, unipay.PayWay_WxPay)
+	if err != nil {
+		return err
+	}
+
+	totalFee := order.OrderInfo().TotalFee
+	if refund.RefundFee < totalFee {
+		if err := unipay.CheckTransition(order, unipay.OrderEventPartialRefund); err != nil {
+			// 订单已退款，直接返回; 未支付的订单不能退款
+			if unipay.IsProcessed(err) {
+				return nil
+			}
+			return err
+		}
+
+		partial, ok := svc.(unipay.PartialRefundService)
+		if !ok {
+			return nil
+		}
+		// PartialRefund根据退款单号去重, 重复通知不会重复累计
+		if err := partial.PartialRefund(order, refund.OutRefundNo, refund.RefundFee); err != nil {
+			return err
+		}
+
+		order, err = svc.GetOrderByTradeNo(outTradeNo, unipay.PayWay_WxPay)
+		if err != nil {
+			return err
+		}
+		if ro, ok := order.(unipay.RefundedOrder); !ok || ro.RefundedFee() < totalFee {
+			return nil
+		}
+	}
+
+	if err := unipay.CheckTransition(order, unipay.OrderEventRefund); err != nil {
+		// 订单已退款，直接返回; 未支付的订单不能退款
+		if unipay.IsProcessed(err) {
+			return nil
+		}
+		return err
+	}
+
+	return svc.Revoke(order)
+}
@@ -0,0 +1,226 @@
+package uniwxpay
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lovewith99/unipay"
+	wxpayv2 "github.com/lovewith99/wxpay/v2"
+)
+
+// sandboxPath 仿真测试系统的接口路径前缀
+const sandboxPath = "/sandboxnew"
+
+// requestSignType v2接口的签名类型, 未配置时使用MD5, 仿真测试系统只支持MD5
+func (cli *Client) requestSignType() string {
+	if cli.signType != "" && !cli.sandbox {
+		return cli.signType
+	}
+	return wxpayv2.MD5
+}
+
+// gateway 将wxpayv2中固定的接口地址替换为配置的域名, 开启沙箱时增加/sandboxnew前缀
+func (cli *Client) gateway(uri string) string {
+	path := strings.TrimPrefix(uri, defaultDomain)
+	if cli.sandbox {
+		path = sandboxPath + path
+	}
+	return cli.domain + path
+}
+
+// signKey 签名使用的密钥, 沙箱环境下使用获取到的沙箱密钥
+func (cli *Client) signKey() (string, error) {
+	if !cli.sandbox {
+		return cli.key, nil
+	}
+	return cli.SandboxSignKey()
+}
+
+// SandboxSignKey 获取仿真测试系统的签名密钥, 获取成功后缓存
+// https://pay.weixin.qq.com/wiki/doc/api/tools/sp_coupon.php?chapter=23_1
+func (cli *Client) SandboxSignKey() (string, error) {
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+
+	if cli.sandboxKey != "" {
+		return cli.sandboxKey, nil
+	}
+
+	obj := struct {
+		XMLName  struct{} `xml:"xml"`
+		MchId    string   `xml:"mch_id"`
+		NonceStr string   `xml:"nonce_str"`
+		Sign     string   `xml:"sign"`
+	}{
+		MchId:    cli.mchId,
+		NonceStr: nonceStr(),
+	}
+	obj.Sign = wxpayv2.MakeSign(map[string]interface{}{
+		"mch_id":    obj.MchId,
+		"nonce_str": obj.NonceStr,
+	}, cli.key, wxpayv2.MD5)
+
+	bs, err := xml.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := cli.post(cli.domain+sandboxPath+"/pay/getsignkey", bs)
+	if err != nil {
+		return "", err
+	}
+
+	params, err := ParseParams(bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	if params.GetString("return_code") != "SUCCESS" {
+		return "", respError(params.GetString("return_code"), params.GetString("return_msg"), "", "")
+	}
+
+	cli.sandboxKey = params.GetString("sandbox_signkey")
+	return cli.sandboxKey, nil
+}
+
+// do 调用v2接口, 与wxpayv2.Client.Do不同的是会使用配置的签名类型和域名, 并验证返回结果的签名
+func (cli *Client) do(req wxpayv2.RequestIface, resp interface{}) error {
+	key, err := cli.signKey()
+	if err != nil {
+		return err
+	}
+
+	req.SetAppId(cli.appId)
+	req.SetMchId(cli.mchId)
+	req.SetNonceStr()
+	req.SetSignType(cli.requestSignType())
+	wxpayv2.SetSign(req, key)
+
+	bs, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	body, err := cli.post(cli.gateway(req.GateWay()), bs)
+	if err != nil {
+		return err
+	}
+
+	params, err := ParseParams(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// 返回结果不携带sign_type, 签名类型与请求一致
+	if params.GetString("return_code") == "SUCCESS" && !verifySign(params, key, req.GetSignType()) {
+		return fmt.Errorf("%w: wxpay", unipay.ErrSignatureInvalid)
+	}
+
+	return xml.Unmarshal(body, resp)
+}
+
+// doParams 调用v2接口并将返回结果解析为Params, 通信或业务失败时返回错误
+// 用于wxpayv2未定义返回结构, 或返回字段带有_$n后缀的接口
+func (cli *Client) doParams(req wxpayv2.RequestIface) (wxpayv2.Params, error) {
+	var resp xmlParams
+	if err := cli.do(req, &resp); err != nil {
+		return nil, err
+	}
+
+	params := wxpayv2.Params(resp)
+	if params.GetString("return_code") != "SUCCESS" || params.GetString("result_code") != "SUCCESS" {
+		return nil, respError(params.GetString("return_code"), params.GetString("return_msg"),
+			params.GetString("err_code"), params.GetString("err_code_des"))
+	}
+
+	return params, nil
+}
+
+func (cli *Client) post(uri string, data []byte) ([]byte, error) {
+	resp, err := cli.client.Client.Post(uri, "text/xml; charset=utf-8", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &unipay.ProviderError{
+			PayWay:    unipay.PayWay_WxPay,
+			Code:      strconv.Itoa(resp.StatusCode),
+			Message:   uri + " " + resp.Status,
+			Retryable: resp.StatusCode >= http.StatusInternalServerError,
+		}
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// verifySign 验证报文签名, 不包括sign和空值字段
+func verifySign(params wxpayv2.Params, key, signType string) bool {
+	hm := make(map[string]interface{})
+	for k, v := range params {
+		if k == "sign" || v == "" {
+			continue
+		}
+		hm[k] = v
+	}
+
+	sign := params.GetString("sign")
+	return sign != "" && wxpayv2.MakeSign(hm, key, signType) == sign
+}
+
+// requestData 客户端调起支付的参数, 签名类型与下单时一致
+// wxpayv2.UnifiedOrderResp.RequestData 固定使用MD5签名, 且无法使用沙箱密钥
+func (cli *Client) requestData(resp *unifiedOrderResp) (unipay.MapResult, error) {
+	key, err := cli.signKey()
+	if err != nil {
+		return nil, err
+	}
+
+	signType := cli.requestSignType()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	switch resp.TradeType {
+	case wxpayv2.APP:
+		// https://pay.weixin.qq.com/wiki/doc/api/app/app.php?chapter=9_12
+		sign := wxpayv2.MakeSign(map[string]interface{}{
+			"appid":     resp.AppId,
+			"partnerid": resp.MchId,
+			"prepayid":  resp.PrepayId,
+			"package":   "Sign=WXPay",
+			"noncestr":  resp.NonceStr,
+			"timestamp": timestamp,
+		}, key, signType)
+
+		return map[string]interface{}{
+			"appId":        resp.AppId,
+			"partnerId":    resp.MchId,
+			"prepayId":     resp.PrepayId,
+			"packageValue": "Sign=WXPay",
+			"nonceStr":     resp.NonceStr,
+			"timeStamp":    timestamp,
+			"signType":     signType,
+			"sign":         sign,
+		}, nil
+	case wxpayv2.JSAPI:
+		// https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=7_7&index=6
+		hm := map[string]interface{}{
+			"appId":     resp.AppId,
+			"timeStamp": timestamp,
+			"nonceStr":  resp.NonceStr,
+			"package":   "prepay_id=" + resp.PrepayId,
+			"signType":  signType,
+		}
+		hm["paySign"] = wxpayv2.MakeSign(hm, key, signType)
+		return hm, nil
+	}
+
+	return nil, errors.New("uniwxpay: unsupported trade type: " + resp.TradeType)
+}
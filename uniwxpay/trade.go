@@ -0,0 +1,120 @@
+package uniwxpay
+
+import wxpayv2 "github.com/lovewith99/wxpay/v2"
+
+// 交易状态
+const (
+	TradeStateSuccess    = "SUCCESS"    // 支付成功
+	TradeStateRefund     = "REFUND"     // 转入退款
+	TradeStateNotPay     = "NOTPAY"     // 未支付
+	TradeStateClosed     = "CLOSED"     // 已关闭
+	TradeStateRevoked    = "REVOKED"    // 已撤销(付款码支付)
+	TradeStateUserPaying = "USERPAYING" // 用户支付中(付款码支付)
+	TradeStatePayError   = "PAYERROR"   // 支付失败
+)
+
+// 退款状态
+const (
+	RefundStatusSuccess    = "SUCCESS"    // 退款成功
+	RefundStatusClosed     = "CLOSED"     // 退款关闭
+	RefundStatusProcessing = "PROCESSING" // 退款处理中
+	RefundStatusAbnormal   = "ABNORMAL"   // 退款异常
+)
+
+// Trade 微信支付订单的查询结果
+type Trade struct {
+	OutTradeNo     string // 商户订单号
+	TransactionId  string // 微信支付订单号
+	TradeType      string // 交易类型
+	TradeState     string // 交易状态
+	TradeStateDesc string // 交易状态描述
+	TotalFee       int    // 订单金额, 单位分
+	FeeType        string // 货币类型
+	Attach         string // 附加数据
+	OpenId         string // 用户标识
+	TimeEnd        string // 支付完成时间
+}
+
+// Refund 微信支付退款结果
+type Refund struct {
+	OutTradeNo    string // 商户订单号
+	TransactionId string // 微信支付订单号
+	OutRefundNo   string // 商户退款单号
+	RefundId      string // 微信支付退款单号
+	TotalFee      int    // 订单金额, 单位分
+	RefundFee     int    // 退款金额, 单位分
+	Status        string // 退款状态
+}
+
+// Query 查询订单, 开启QueryInvoke后会处理已支付但未收到通知的订单
+func (cli *Client) Query(outTradeNo string) (*Trade, error) {
+	var (
+		trade *Trade
+		err   error
+	)
+
+	if cli.v3 != nil {
+		trade, err = cli.queryV3(outTradeNo)
+	} else {
+		trade, err = cli.queryV2(outTradeNo)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cli.QueryInvoke && trade.TradeState == TradeStateSuccess {
+		if err := cli.paid(trade.OutTradeNo, trade.TransactionId, totalAmount(int64(trade.TotalFee), trade.FeeType)); err != nil {
+			return trade, err
+		}
+	}
+
+	return trade, nil
+}
+
+func (cli *Client) queryV2(outTradeNo string) (*Trade, error) {
+	obj := wxpayv2.OrderQueryReq{}
+	obj.OutTradeNo = outTradeNo
+
+	var resp wxpayv2.OrderQueryResp
+	if err := cli.do(&obj, &resp); err != nil {
+		return nil, err
+	}
+
+	if !resp.IsSuccess() {
+		return nil, respError(resp.ReturnCode, resp.ReturnMsg, resp.ErrCode, resp.ErrCodeDes)
+	}
+
+	return &Trade{
+		OutTradeNo:     resp.OutTradeNo,
+		TransactionId:  resp.TransactionId,
+		TradeType:      resp.TradeType,
+		TradeState:     resp.TradeState,
+		TradeStateDesc: resp.TradeStateDesc,
+		TotalFee:       resp.TotalFee,
+		FeeType:        resp.FeeType,
+		Attach:         resp.Attach,
+		OpenId:         resp.OpenId,
+		TimeEnd:        resp.TimeEnd,
+	}, nil
+}
+
+// Close 关闭未支付的订单, 订单已关闭时返回nil
+func (cli *Client) Close(outTradeNo string) error {
+	if cli.v3 != nil {
+		return cli.closeV3(outTradeNo)
+	}
+
+	obj := wxpayv2.CloseOrderReq{}
+	obj.OutTradeNo = outTradeNo
+
+	var resp wxpayv2.CloseOrderResp
+	if err := cli.do(&obj, &resp); err != nil {
+		return err
+	}
+
+	if resp.IsSuccess() || resp.ErrCode == "ORDERCLOSED" {
+		return nil
+	}
+
+	return respError(resp.ReturnCode, resp.ReturnMsg, resp.ErrCode, resp.ErrCodeDes)
+}